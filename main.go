@@ -2,26 +2,405 @@ package main
 
 import (
 	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"embed"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
 	"html/template"
-	"log"
+	"io"
+	"log/slog"
+	"math"
+	"math/bits"
+	mathrand "math/rand"
 	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
 // ServerInfo 存储服务器的基本信息和查询到的状态
 type ServerInfo struct {
-	Address    string
-	LastSeen   time.Time
-	Name       string
-	Map        string
-	Players    int
-	MaxPlayers int
+	Address    string        `json:"address"`            // IPv6 地址带方括号，例如 [2001:db8::1]:27015
+	Family     string        `json:"family"`             // ipv4 或 ipv6
+	Source     string        `json:"source,omitempty"`   // upstream 表示从上游 Master 的列表得知，为空表示直接发送心跳
+	Hostname   string        `json:"hostname,omitempty"` // 反向解析得到的主机名，需开启 -reverse-dns
+	FirstSeen  time.Time     `json:"firstSeen"`          // 首次注册时间，刷新心跳时不变
+	LastSeen   time.Time     `json:"lastSeen"`
+	Name       string        `json:"name"`
+	Map        string        `json:"map"`
+	GameDir    string        `json:"gameDir"`  // 游戏目录，例如 cstrike
+	GameDesc   string        `json:"gameDesc"` // A2S_INFO 中的游戏描述，例如 Counter-Strike 或 Mod 名称
+	Players    int           `json:"players"`
+	MaxPlayers int           `json:"maxPlayers"`
+	Bots       int           `json:"bots"`
+	OS         string        `json:"os"`
+	Dedicated  bool          `json:"dedicated"`
+	Secure     bool          `json:"secure"`
+	Passworded bool          `json:"passworded"`
+	Version    string        `json:"version"`
+	Protocol   int           `json:"protocol"`           // 网络协议版本，GoldSrc 为 47/48，Source 为 7 等
+	Engine     string        `json:"engine,omitempty"`   // 根据 A2S_INFO 回复判断的引擎: goldsrc 或 source，心跳自带信息时为空
+	GameID     int           `json:"gameId"`             // Steam App ID，例如 CS 1.6 为 10；旧版 GoldSrc 回复中没有，为 0
+	GamePort   int           `json:"gamePort,omitempty"` // EDF 中声明的游戏端口
+	Keywords   []string      `json:"keywords"`           // EDF 中的关键字 (sv_tags)，用于 gametype 过滤
+	Ping       time.Duration `json:"-"`                  // A2S_INFO 往返延迟
+	Stale      bool          `json:"stale"`              // 最近一次查询超时，数据可能已过期
+	Listed     bool          `json:"listed"`             // 至少成功响应过一次 A2S_INFO，才会出现在 Master 列表中
+	FailCount  int           `json:"failCount"`          // 连续查询失败次数
+
+	QueryResults queryResults `json:"-"`           // 最近 -reliability-window 次 A2S_INFO 查询是否成功
+	Reliability  float64      `json:"reliability"` // 最近几次查询的成功率 (%)，尚未查询过时为 0
+
+	LastQueryTime    time.Time `json:"lastQueryTime"`        // 最近一次 A2S_INFO 查询完成的时间
+	LastQuerySuccess time.Time `json:"lastQuerySuccess"`     // 最近一次 A2S_INFO 查询成功的时间，与 LastSeen (心跳) 对照
+	LastError        string    `json:"lastError,omitempty"`  // 最近一次查询失败的原因，成功后清空
+	Pinned           bool      `json:"pinned"`               // 由 -pinned 指定，网页中总是排在最前
+	Tags             []string  `json:"tags,omitempty"`       // 由 -tags 文件指定的标签，例如 official、24/7 dust2
+	Offline          bool      `json:"offline,omitempty"`    // 置顶服务器当前不在列表中时生成的占位条目
+	InlineInfo       bool      `json:"inlineInfo,omitempty"` // 最近一次心跳自带服务器信息 (\hostname\ 等)，不再发送 A2S_INFO
+
+	HeartbeatCount        int           `json:"heartbeatCount"` // 注册以来收到的心跳次数
+	LastHeartbeatInterval time.Duration `json:"-"`              // 最近两次心跳的间隔，JSON 中以毫秒输出
+
+	Country     string   `json:"country"`     // GeoIP 解析的国家名称
+	CountryCode string   `json:"countryCode"` // ISO 3166-1 两位代码
+	Region      int      `json:"region"`      // Valve 区域代码 (0x00-0x07)，-1 表示未知
+	PlayerList  []Player `json:"-"`           // A2S_PLAYER 结果，通过 /api/players 获取
+
+	PlayersUpdated   time.Time `json:"-"` // 最近一次刷新玩家列表的时间
+	RefreshRequested time.Time `json:"-"` // 详情页最近一次请求补查的时间，查询失败时同样记录
+
+	Rules        map[string]string `json:"-"` // A2S_RULES 返回的 cvar，在详情页显示
+	RulesUpdated time.Time         `json:"-"` // 最近一次查询 A2S_RULES 的时间，失败时同样记录，不回复的服务器按间隔重试
+
+	PeakPlayers     int       `json:"peakPlayers"`     // 今日 (本地时间) 最高人数，零点重置
+	PeakPlayersTime time.Time `json:"peakPlayersTime"` // 今日峰值出现的时间
+	AllTimePeak     int       `json:"allTimePeak"`     // 历史最高人数
+	AllTimePeakTime time.Time `json:"allTimePeakTime"`
+
+	History playerHistory `json:"-"` // 最近的人数采样，通过 /api/history 获取
+}
+
+// historyPoint 一次成功查询时的人数和延迟
+type historyPoint struct {
+	Time    time.Time `json:"t"`
+	Players int       `json:"players"`
+	PingMs  int64     `json:"ping,omitempty"` // 心跳自带信息时没有延迟
+}
+
+// playerHistory 固定长度的环形缓冲，写满后覆盖最旧的采样。
+// 只能在 ServerManager 的锁内读写，ServerManager.Get 返回的副本中是单独复制的一份。
+type playerHistory struct {
+	points []historyPoint
+	next   int // 下一次写入的位置
+}
+
+// add 追加一个采样，size 为缓冲长度，0 表示不记录
+func (h *playerHistory) add(p historyPoint, size int) {
+	if size <= 0 {
+		return
+	}
+	if len(h.points) < size {
+		h.points = append(h.points, p)
+		h.next = len(h.points) % size
+		return
+	}
+	h.points[h.next] = p
+	h.next = (h.next + 1) % size
+}
+
+// Samples 按时间从旧到新返回采样的副本
+func (h *playerHistory) Samples() []historyPoint {
+	out := make([]historyPoint, 0, len(h.points))
+	out = append(out, h.points[h.next:]...)
+	return append(out, h.points[:h.next]...)
+}
+
+// queryResults 最近若干次查询的结果，最低位是最近的一次，1 表示成功，最多记录 64 次
+type queryResults struct {
+	bits  uint64
+	count int
+}
+
+// add 记录一次查询结果，window 为统计的次数
+func (q *queryResults) add(ok bool, window int) {
+	q.bits <<= 1
+	if ok {
+		q.bits |= 1
+	}
+	if q.count < window {
+		q.count++
+	}
+	if q.count < 64 {
+		q.bits &= 1<<q.count - 1
+	}
+}
+
+// recordQuery 记录一次 A2S_INFO 查询的结果并更新成功率
+func (s *ServerInfo) recordQuery(ok bool) {
+	s.QueryResults.add(ok, config.ReliabilityWindow)
+	ratio := float64(bits.OnesCount64(s.QueryResults.bits)) / float64(s.QueryResults.count)
+	s.Reliability = math.Round(ratio*1000) / 10
+}
+
+// Grade 按查询成功率给出等级: A >= 95%, B >= 85%, C >= 70%, D >= 50%, 更低为 F；尚未查询过时为空
+func (s ServerInfo) Grade() string {
+	switch {
+	case s.QueryResults.count == 0:
+		return ""
+	case s.Reliability >= 95:
+		return "A"
+	case s.Reliability >= 85:
+		return "B"
+	case s.Reliability >= 70:
+		return "C"
+	case s.Reliability >= 50:
+		return "D"
+	}
+	return "F"
+}
+
+// GradeClass 等级徽章的 Bootstrap 颜色，与页面脚本中的 gradeClass 保持一致
+func (s ServerInfo) GradeClass() string {
+	switch s.Grade() {
+	case "A":
+		return "bg-success"
+	case "B":
+		return "bg-primary"
+	case "C":
+		return "bg-info"
+	case "D":
+		return "bg-warning"
+	}
+	return "bg-danger"
+}
+
+// applyInfo 用 A2S_INFO 的结果或心跳中自带的信息更新服务器，并记录人数峰值和历史采样
+func (s *ServerInfo) applyInfo(info *ServerInfo, now time.Time) {
+	s.Name = info.Name
+	s.Map = info.Map
+	s.GameDir = info.GameDir
+	s.GameDesc = info.GameDesc
+	s.Dedicated = info.Dedicated
+	s.Players = info.Players
+	s.MaxPlayers = info.MaxPlayers
+	s.Bots = info.Bots
+	s.OS = info.OS
+	s.Secure = info.Secure
+	s.Passworded = info.Passworded
+	s.Version = info.Version
+	s.Protocol = info.Protocol
+	s.Engine = info.Engine
+	s.GameID = info.GameID
+	s.GamePort = info.GamePort
+	s.Keywords = info.Keywords
+	s.updatePeak(info.Players, now)
+	s.History.add(historyPoint{Time: now, Players: info.Players, PingMs: info.Ping.Milliseconds()}, config.HistoryLength)
+}
+
+// updatePeak 用本次查询到的人数刷新今日和历史峰值，跨过本地零点时今日峰值从当前人数重新开始
+func (s *ServerInfo) updatePeak(players int, now time.Time) {
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	if s.PeakPlayersTime.Before(midnight) || players > s.PeakPlayers {
+		s.PeakPlayers = players
+		s.PeakPlayersTime = now
+	}
+	if players > s.AllTimePeak || s.AllTimePeakTime.IsZero() {
+		s.AllTimePeak = players
+		s.AllTimePeakTime = now
+	}
+}
+
+// Player A2S_PLAYER 返回的玩家信息
+type Player struct {
+	Name     string  `json:"name"`
+	Score    int32   `json:"score"`
+	Duration float32 `json:"duration"` // 在线秒数
+}
+
+// DurationText 以 "1小时5分" 的形式返回玩家的在线时长
+func (p Player) DurationText() string {
+	return formatDuration(time.Duration(p.Duration) * time.Second)
+}
+
+// Flag 返回国家旗帜 emoji，供模板使用
+func (s ServerInfo) Flag() string {
+	return countryFlag(s.CountryCode)
+}
+
+// Uptime 返回自首次注册以来的时长
+func (s ServerInfo) Uptime() time.Duration {
+	if s.FirstSeen.IsZero() {
+		return 0
+	}
+	return time.Since(s.FirstSeen)
+}
+
+// UptimeText 以 "3天4小时"、"5小时12分" 的形式返回在线时长
+func (s ServerInfo) UptimeText() string {
+	return formatDuration(s.Uptime())
+}
+
+// formatDuration 把时长格式化为最多两级的中文表示
+func formatDuration(d time.Duration) string {
+	days := int(d / (24 * time.Hour))
+	hours := int(d/time.Hour) % 24
+	minutes := int(d/time.Minute) % 60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%d天%d小时", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%d小时%d分", hours, minutes)
+	}
+	return fmt.Sprintf("%d分", minutes)
+}
+
+// unresponsiveAfter 仍在发送心跳、但超过该时长没有成功响应查询的服务器视为无响应
+const unresponsiveAfter = 2 * time.Minute
+
+// Unresponsive 报告服务器最近发送过心跳，却超过 unresponsiveAfter 没有成功响应 A2S_INFO，
+// 通常是防火墙拦截了查询或伪造的注册。从未成功过时从首次注册算起；心跳自带信息的服务器不查询，不会无响应。
+func (s ServerInfo) Unresponsive() bool {
+	if s.Offline || s.InlineInfo || time.Since(s.LastSeen) > unresponsiveAfter {
+		return false
+	}
+	since := s.LastQuerySuccess
+	if since.IsZero() {
+		since = s.FirstSeen
+	}
+	return time.Since(since) > unresponsiveAfter
+}
+
+// MarshalJSON 按 -json-time-format 和 -json-field-names 输出 API 中的服务器信息
+func (s ServerInfo) MarshalJSON() ([]byte, error) {
+	return s.marshalJSON(config.JSONTimeFormat, config.JSONFieldNames)
+}
+
+// marshalJSON 输出 JSON 时延迟以毫秒表示，时间按 timeFormat 输出，并附带计算出的无响应标记；
+// fieldNames 为 snake 时字段名改为 snake_case
+func (s ServerInfo) marshalJSON(timeFormat, fieldNames string) ([]byte, error) {
+	type plain ServerInfo
+	data, err := json.Marshal(struct {
+		plain
+		Ping                  int64  `json:"ping"`
+		LastHeartbeatInterval int64  `json:"lastHeartbeatInterval"`
+		Unresponsive          bool   `json:"unresponsive"`
+		Grade                 string `json:"grade,omitempty"`
+
+		// 同名字段覆盖 plain 中的 time.Time
+		FirstSeen        any `json:"firstSeen"`
+		LastSeen         any `json:"lastSeen"`
+		LastQueryTime    any `json:"lastQueryTime"`
+		LastQuerySuccess any `json:"lastQuerySuccess"`
+		PeakPlayersTime  any `json:"peakPlayersTime"`
+		AllTimePeakTime  any `json:"allTimePeakTime"`
+	}{
+		plain(s), s.Ping.Milliseconds(), s.LastHeartbeatInterval.Milliseconds(), s.Unresponsive(), s.Grade(),
+		jsonTime(s.FirstSeen, timeFormat), jsonTime(s.LastSeen, timeFormat), jsonTime(s.LastQueryTime, timeFormat),
+		jsonTime(s.LastQuerySuccess, timeFormat), jsonTime(s.PeakPlayersTime, timeFormat), jsonTime(s.AllTimePeakTime, timeFormat),
+	})
+	if err != nil || fieldNames != "snake" {
+		return data, err
+	}
+	return snakeCaseKeys(data)
+}
+
+// jsonTime 按 format 转换时间: rfc3339 保持 time.Time 的默认格式，
+// unix 和 unixms 输出秒或毫秒时间戳，零值输出 0
+func jsonTime(t time.Time, format string) any {
+	switch format {
+	case "unix":
+		if t.IsZero() {
+			return 0
+		}
+		return t.Unix()
+	case "unixms":
+		if t.IsZero() {
+			return 0
+		}
+		return t.UnixMilli()
+	}
+	return t
+}
+
+// snakeCaseKeys 把 JSON 对象顶层的 camelCase 字段名改为 snake_case，字段顺序和值不变。
+// ServerInfo 中嵌套的值 (keywords、tags) 没有字段名，不需要递归处理
+func snakeCaseKeys(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("unexpected JSON token %v", tok)
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(snakeCase(key))
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// snakeCase 把 camelCase 转为 snake_case，例如 maxPlayers 转为 max_players
+func snakeCase(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if 'A' <= r && r <= 'Z' {
+			b.WriteByte('_')
+			r += 'a' - 'A'
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// eventServer 以固定格式 (camelCase 字段名、RFC 3339 时间) 输出服务器信息，
+// 供内置页面使用的 /events，不受 -json-field-names 和 -json-time-format 影响
+type eventServer struct{ *ServerInfo }
+
+func (s eventServer) MarshalJSON() ([]byte, error) {
+	return s.marshalJSON("rfc3339", "camel")
 }
 
-// ServerManager 管理服务器列表的并发安全
+// ServerManager 管理服务器列表的并发安全，所有读写都通过它的方法进行，不要直接访问 servers
 type ServerManager struct {
 	servers map[string]*ServerInfo
 	mu      sync.RWMutex
@@ -31,6 +410,137 @@ var manager = ServerManager{
 	servers: make(map[string]*ServerInfo),
 }
 
+// errServerListFull 服务器数量已达 -max-servers 且没有可以挤掉的条目
+var errServerListFull = errors.New("server list full")
+
+// Get 返回服务器的副本，人数历史也一并复制，可以在不持有锁时读取
+func (m *ServerManager) Get(address string) (ServerInfo, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	s, ok := m.servers[address]
+	if !ok {
+		return ServerInfo{}, false
+	}
+	c := *s
+	c.History = playerHistory{points: s.History.Samples()}
+	return c, true
+}
+
+// Len 返回当前记录的服务器数量
+func (m *ServerManager) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return len(m.servers)
+}
+
+// Snapshot 返回所有服务器的浅拷贝，顺序不固定
+func (m *ServerManager) Snapshot() []*ServerInfo {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	list := make([]*ServerInfo, 0, len(m.servers))
+	for _, s := range m.servers {
+		c := *s
+		list = append(list, &c)
+	}
+	return list
+}
+
+// Each 持有读锁依次对每个服务器调用 fn，用于不需要复制整份列表的统计；fn 不能修改或保留 s
+func (m *ServerManager) Each(fn func(s *ServerInfo)) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.servers {
+		fn(s)
+	}
+}
+
+// Add 加入新服务器，地址已存在时不覆盖并返回 false。
+// max > 0 且列表已满时先尝试挤掉一个从未响应过的待验证条目，挤不掉时返回 errServerListFull。
+func (m *ServerManager) Add(s *ServerInfo, max int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, exists := m.servers[s.Address]; exists {
+		return false, nil
+	}
+	if max > 0 && len(m.servers) >= max && !m.evictLocked() {
+		return false, errServerListFull
+	}
+	m.servers[s.Address] = s
+	return true, nil
+}
+
+// Update 持有写锁对已存在的服务器调用 fn，服务器不存在时返回 false
+func (m *ServerManager) Update(address string, fn func(s *ServerInfo)) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.servers[address]
+	if ok {
+		fn(s)
+	}
+	return ok
+}
+
+// UpdateAll 持有写锁对每个服务器调用 fn
+func (m *ServerManager) UpdateAll(fn func(s *ServerInfo)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, s := range m.servers {
+		fn(s)
+	}
+}
+
+// Remove 移除服务器并返回移除前的副本
+func (m *ServerManager) Remove(address string) (ServerInfo, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.servers[address]
+	if !ok {
+		return ServerInfo{}, false
+	}
+	delete(m.servers, address)
+	return *s, true
+}
+
+// RemoveFunc 持有写锁移除所有使 match 返回 true 的服务器，返回被移除条目的副本
+func (m *ServerManager) RemoveFunc(match func(s *ServerInfo) bool) []ServerInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var removed []ServerInfo
+	for addr, s := range m.servers {
+		if match(s) {
+			delete(m.servers, addr)
+			removed = append(removed, *s)
+		}
+	}
+	return removed
+}
+
+// evictLocked 列表已满时为新服务器腾出位置: 移除最早出现的、查询过但从未响应的待验证条目，
+// 这类条目多半来自伪造的心跳；已验证的服务器不会被挤掉。调用方需持有 m.mu 写锁。
+func (m *ServerManager) evictLocked() bool {
+	var victim *ServerInfo
+	for _, s := range m.servers {
+		if s.Listed || s.Pinned || s.FailCount == 0 {
+			continue
+		}
+		if victim == nil || s.FirstSeen.Before(victim.FirstSeen) {
+			victim = s
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	delete(m.servers, victim.Address)
+	slog.Info("Server evicted", "addr", victim.Address, "reason", "server list full")
+	events.Publish(eventRemoved, victim.Address, victim.Name)
+	return true
+}
+
+// 页面使用的样式表和图标，编译进二进制文件，离线环境也能正常显示
+//
+//go:embed static
+var staticFS embed.FS
+
 // HTML 模板
 const htmlTemplate = `
 <!DOCTYPE html>
@@ -38,209 +548,5914 @@ const htmlTemplate = `
 <head>
     <meta charset="UTF-8">
     <meta name="viewport" content="width=device-width, initial-scale=1">
-    <title>CS 1.6 Server List</title>
-    <link href="https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css" rel="stylesheet">
-    <style>body { padding: 20px; background-color: #f8f9fa; } .table { background: white; }</style>
+    <title>{{ or siteTitle "CS 1.6 Server List" }}</title>
+    {{ if and (not .Live) .Refresh }}<meta http-equiv="refresh" content="{{ .Refresh }}">{{ end }}
+    <link href="/static/style.css" rel="stylesheet">
 </head>
 <body>
     <div class="container">
-        <h2 class="mb-4">在线 CS 服务器列表</h2>
-        <div class="alert alert-info">当前在线服务器数量: {{ .Count }}</div>
+        <h2 class="mb-4">{{ with logoURL }}<img src="{{ . }}" alt="" height="40" class="align-middle me-1"> {{ end }}{{ or siteTitle "在线 CS 服务器列表" }} <a class="btn btn-outline-secondary btn-sm align-middle" href="/by-map">按地图</a></h2>
+        <div class="row g-2 mb-3 text-center">
+            <div class="col-6 col-md"><div class="card"><div class="card-body py-2"><div class="text-muted small">服务器</div><div class="fs-4" id="stat-servers">{{ .Stats.Servers }}</div></div></div></div>
+            <div class="col-6 col-md"><div class="card"><div class="card-body py-2"><div class="text-muted small">玩家 / 容量</div><div class="fs-4" id="stat-players">{{ .Stats.Players }} / {{ .Stats.Capacity }}</div></div></div></div>
+            <div class="col-6 col-md"><div class="card"><div class="card-body py-2"><div class="text-muted small">热门地图</div><div class="fs-4" id="stat-map">{{ if .Stats.TopMap }}{{ .Stats.TopMap }}{{ else }}-{{ end }}</div></div></div></div>
+            <div class="col-6 col-md"><div class="card"><div class="card-body py-2"><div class="text-muted small">平均延迟</div><div class="fs-4" id="stat-ping">{{ if .Stats.AvgPingMs }}{{ .Stats.AvgPingMs }} ms{{ else }}-{{ end }}</div></div></div></div>
+        </div>
+        <form class="row g-2 mb-3" method="get">
+            <div class="col-md-3"><input class="form-control" name="q" value="{{ .Query.Get "q" }}" placeholder="搜索服务器名称或地图"></div>
+            <div class="col-md-2"><input class="form-control" name="map" value="{{ .Query.Get "map" }}" placeholder="地图 (精确匹配)"></div>
+            <div class="col-md-2"><input class="form-control" name="game" value="{{ .Query.Get "game" }}" placeholder="游戏 / Mod"></div>
+            <div class="col-md-1"><input class="form-control" name="country" value="{{ .Query.Get "country" }}" placeholder="国家"></div>
+            <div class="col-md-1"><input class="form-control" type="number" min="0" name="minplayers" value="{{ .Query.Get "minplayers" }}" placeholder="最少人数"></div>
+            <div class="col-md-1 form-check pt-2"><label class="form-check-label"><input class="form-check-input" type="checkbox" name="dedup" value="1"{{ if eq (.Query.Get "dedup") "1" }} checked{{ end }}> 去重</label></div>
+            <div class="col-md-2"><button class="btn btn-primary w-100" type="submit">筛选</button></div>
+            {{ if .Query.Get "limit" }}<input type="hidden" name="limit" value="{{ .Query.Get "limit" }}">{{ end }}
+            {{ if .Query.Get "tag" }}<input type="hidden" name="tag" value="{{ .Query.Get "tag" }}">{{ end }}
+        </form>
+        <div class="alert alert-info" id="count">当前在线服务器数量: {{ .Count }}{{ if ne .Count .Total }} (共 {{ .Total }}){{ end }}</div>
         <table class="table table-striped table-hover border">
             <thead class="table-dark">
                 <tr>
-                    <th>服务器名称</th>
+                    <th><a class="link-light" href="{{ index .SortLinks "name" }}">服务器名称</a>{{ if eq .Sort "name" }} {{ if .Desc }}&darr;{{ else }}&uarr;{{ end }}{{ end }}</th>
                     <th>地址 (IP:Port)</th>
-                    <th>地图</th>
-                    <th>人数</th>
-                    <th>最后更新</th>
+                    <th><a class="link-light" href="{{ index .SortLinks "map" }}">地图</a>{{ if eq .Sort "map" }} {{ if .Desc }}&darr;{{ else }}&uarr;{{ end }}{{ end }}</th>
+                    <th>游戏</th>
+                    <th><a class="link-light" href="{{ index .SortLinks "players" }}">人数</a>{{ if eq .Sort "players" }} {{ if .Desc }}&darr;{{ else }}&uarr;{{ end }}{{ end }}</th>
+                    <th>国家</th>
+                    <th>系统</th>
+                    <th>VAC</th>
+                    <th>密码</th>
+                    <th><a class="link-light" href="{{ index .SortLinks "ping" }}">延迟</a>{{ if eq .Sort "ping" }} {{ if .Desc }}&darr;{{ else }}&uarr;{{ end }}{{ end }}</th>
+                    <th>在线时长</th>
+                    <th><a class="link-light" href="{{ index .SortLinks "lastseen" }}">最后更新</a>{{ if eq .Sort "lastseen" }} {{ if .Desc }}&darr;{{ else }}&uarr;{{ end }}{{ end }}</th>
                 </tr>
             </thead>
-            <tbody>
+            <tbody id="servers">
                 {{ range .Servers }}
-                <tr>
-                    <td>{{ .Name }}</td>
-                    <td>{{ .Address }}</td>
+                <tr{{ if or .Pinned .Stale .Offline }} class="{{ if .Pinned }}table-warning {{ end }}{{ if or .Stale .Offline }}text-muted{{ end }}"{{ end }}{{ if .Offline }} title="置顶服务器未在线"{{ else if .Stale }} title="最近一次查询超时"{{ end }}>
+                    <td>{{ if .Pinned }}&#9733; {{ end }}<a href="/server?addr={{ .Address }}">{{ .Name }}</a>{{ range .Tags }} <a class="badge bg-info text-decoration-none" href="/?tag={{ . }}">{{ . }}</a>{{ end }}{{ if .Offline }} <span class="badge bg-danger">离线</span>{{ else if .Unresponsive }} <span class="badge bg-warning" title="持续发送心跳但不响应查询">无响应</span>{{ else if not .Listed }} <span class="badge bg-secondary">待验证</span>{{ end }}</td>
+                    <td{{ if .Hostname }} title="{{ .Hostname }}"{{ end }}>{{ .Address }}</td>
                     <td>{{ .Map }}</td>
-                    <td>{{ .Players }}/{{ .MaxPlayers }}</td>
-                    <td>{{ .LastSeen.Format "15:04:05" }}</td>
+                    <td{{ if .GameDir }} title="{{ .GameDir }}"{{ end }}>{{ .GameDesc }}</td>
+                    <td{{ if not .PeakPlayersTime.IsZero }} title="今日峰值 {{ .PeakPlayers }} ({{ .PeakPlayersTime.Format "15:04" }})，历史峰值 {{ .AllTimePeak }} ({{ .AllTimePeakTime.Format "2006-01-02" }})"{{ end }}>{{ .Players }}/{{ .MaxPlayers }}{{ if .Bots }} <span class="text-muted">({{ .Bots }} 机器人)</span>{{ end }}</td>
+                    <td>{{ if .CountryCode }}<span title="{{ .Country }}">{{ .Flag }} {{ .CountryCode }}</span>{{ end }}</td>
+                    <td>{{ .OS }}</td>
+                    <td>{{ if .Secure }}是{{ else }}否{{ end }}</td>
+                    <td>{{ if .Passworded }}是{{ else }}否{{ end }}</td>
+                    <td>{{ if .Ping }}{{ .Ping.Milliseconds }} ms{{ end }}{{ if .Stale }} (超时){{ end }}{{ if .Grade }} <span class="badge {{ .GradeClass }}" title="最近查询成功率 {{ .Reliability }}%">{{ .Grade }}</span>{{ end }}</td>
+                    {{ if .Offline }}<td>-</td><td>-</td>{{ else }}
+                    <td title="首次出现于 {{ .FirstSeen.Format "2006-01-02 15:04:05" }}">{{ .UptimeText }}</td>
+                    <td>{{ .LastSeen.Format "15:04:05" }}</td>{{ end }}
                 </tr>
                 {{ end }}
             </tbody>
         </table>
-        <div class="text-muted small">自动刷新中...</div>
+        {{ if .Paged }}
+        <nav class="d-flex align-items-center gap-2 mb-2">
+            {{ if .PrevLink }}<a class="btn btn-outline-secondary btn-sm" href="{{ .PrevLink }}">&laquo; 上一页</a>{{ end }}
+            <span class="text-muted">第 {{ .Page.Page }} / {{ .Page.Pages }} 页</span>
+            {{ if .NextLink }}<a class="btn btn-outline-secondary btn-sm" href="{{ .NextLink }}">下一页 &raquo;</a>{{ end }}
+        </nav>
+        {{ end }}
+        <div class="text-muted small">{{ if .Live }}实时更新中...{{ else if .Refresh }}每 {{ .Refresh }} 秒自动刷新{{ end }}</div>
     </div>
-    <script>setTimeout(function(){ location.reload(); }, 10000);</script>
+    {{ if .Live }}
+    <script>
+    (function () {
+        var refresh = {{ .Refresh }} * 1000;
+        function reloadLater() {
+            if (refresh > 0) { setTimeout(function(){ location.reload(); }, refresh); }
+        }
+        // 不支持 SSE 的浏览器退回整页刷新
+        if (!window.EventSource) {
+            reloadLater();
+            return;
+        }
+        function esc(v) {
+            var d = document.createElement('div');
+            d.textContent = v == null ? '' : String(v);
+            return d.innerHTML;
+        }
+        function yesNo(b) { return b ? '是' : '否'; }
+        // 与 ServerInfo.GradeClass 保持一致
+        var gradeClass = { A: 'bg-success', B: 'bg-primary', C: 'bg-info', D: 'bg-warning', F: 'bg-danger' };
+        function uptime(first) {
+            var m = Math.max(0, Math.floor((Date.now() - new Date(first)) / 60000));
+            var d = Math.floor(m / 1440), h = Math.floor(m / 60) % 24;
+            if (d > 0) { return d + '天' + h + '小时'; }
+            if (h > 0) { return h + '小时' + (m % 60) + '分'; }
+            return m + '分';
+        }
+        function flag(code) {
+            if (!/^[A-Za-z]{2}$/.test(code || '')) { return ''; }
+            return String.fromCodePoint.apply(null, code.toUpperCase().split('').map(function (c) {
+                return 0x1F1E6 + c.charCodeAt(0) - 65;
+            }));
+        }
+        function row(s) {
+            var players = s.players + '/' + s.maxPlayers;
+            if (s.bots) { players += ' <span class="text-muted">(' + s.bots + ' 机器人)</span>'; }
+            var ping = (s.ping ? s.ping + ' ms' : '') + (s.stale ? ' (超时)' : '');
+            if (s.grade) { ping += ' <span class="badge ' + gradeClass[s.grade] + '" title="最近查询成功率 ' + s.reliability + '%">' + s.grade + '</span>'; }
+            var peak = '';
+            if (s.peakPlayersTime && s.peakPlayersTime.indexOf('0001-') !== 0) {
+                var at = new Date(s.peakPlayersTime).toLocaleTimeString('zh-CN', { hour12: false, hour: '2-digit', minute: '2-digit' });
+                var allAt = new Date(s.allTimePeakTime).toLocaleDateString('sv-SE');
+                peak = ' title="今日峰值 ' + s.peakPlayers + ' (' + at + ')，历史峰值 ' + s.allTimePeak + ' (' + allAt + ')"';
+            }
+            var tags = (s.tags || []).map(function (t) {
+                return ' <a class="badge bg-info text-decoration-none" href="/?tag=' + encodeURIComponent(t) + '">' + esc(t) + '</a>';
+            }).join('');
+            var badge = s.offline ? ' <span class="badge bg-danger">离线</span>' :
+                s.unresponsive ? ' <span class="badge bg-warning" title="持续发送心跳但不响应查询">无响应</span>' :
+                (s.listed ? '' : ' <span class="badge bg-secondary">待验证</span>');
+            var seen = s.offline ? '-' : new Date(s.lastSeen).toLocaleTimeString('zh-CN', { hour12: false });
+            var cls = (s.pinned ? 'table-warning' : '') + (s.stale || s.offline ? ' text-muted' : '');
+            var title = s.offline ? ' title="置顶服务器未在线"' : (s.stale ? ' title="最近一次查询超时"' : '');
+            return '<tr class="' + cls + '"' + title + '>' +
+                '<td>' + (s.pinned ? '&#9733; ' : '') + '<a href="/server?addr=' + encodeURIComponent(s.address) + '">' + esc(s.name) + '</a>' + tags + badge + '</td>' +
+                '<td' + (s.hostname ? ' title="' + esc(s.hostname) + '"' : '') + '>' + esc(s.address) + '</td>' +
+                '<td>' + esc(s.map) + '</td>' +
+                '<td' + (s.gameDir ? ' title="' + esc(s.gameDir) + '"' : '') + '>' + esc(s.gameDesc) + '</td>' +
+                '<td' + peak + '>' + players + '</td>' +
+                '<td>' + (s.countryCode ? '<span title="' + esc(s.country) + '">' + flag(s.countryCode) + ' ' + esc(s.countryCode) + '</span>' : '') + '</td>' +
+                '<td>' + esc(s.os) + '</td>' +
+                '<td>' + yesNo(s.secure) + '</td>' +
+                '<td>' + yesNo(s.passworded) + '</td>' +
+                '<td>' + ping + '</td>' +
+                '<td>' + (s.offline ? '-' : uptime(s.firstSeen)) + '</td>' +
+                '<td>' + seen + '</td>' +
+                '</tr>';
+        }
+        var source = new EventSource('/events' + location.search);
+        // 连接数已满等原因被拒绝时浏览器不会自动重连，退回整页刷新
+        source.onerror = function () {
+            if (source.readyState === EventSource.CLOSED) {
+                reloadLater();
+            }
+        };
+        source.addEventListener('servers', function (e) {
+            var data = JSON.parse(e.data);
+            var text = '当前在线服务器数量: ' + data.count;
+            if (data.count !== data.total) { text += ' (共 ' + data.total + ')'; }
+            document.getElementById('count').textContent = text;
+            var st = data.stats;
+            document.getElementById('stat-servers').textContent = st.servers;
+            document.getElementById('stat-players').textContent = st.players + ' / ' + st.capacity;
+            document.getElementById('stat-map').textContent = st.topMap || '-';
+            document.getElementById('stat-ping').textContent = st.avgPingMs ? st.avgPingMs + ' ms' : '-';
+            document.getElementById('servers').innerHTML = data.servers.map(row).join('');
+        });
+    })();
+    </script>
+    {{ end }}
 </body>
 </html>
 `
 
-func main() {
-	// 1. 启动 UDP Master Server 监听 (27010)
-	go startUDPServer()
+// Config 保存命令行参数
+type Config struct {
+	UDPAddrs          string
+	WebAddr           string
+	QueryInterval     time.Duration
+	ServerTimeout     time.Duration
+	QueryTimeout      time.Duration
+	StateFile         string
+	BanFile           string
+	QueryWorkers      int
+	HidePending       bool
+	AllowPrivate      bool
+	HideEmpty         bool
+	MinRealPlayers    int
+	GeoIPDB           string
+	LogLevel          string
+	JSONTimeFormat    string
+	JSONFieldNames    string
+	QueryRetries      int
+	EmptyQueryEvery   int
+	MaxQueryFails     int
+	QueryFailTimeout  time.Duration
+	AdminToken        string
+	CORSOrigin        string
+	Template          string
+	SiteTitle         string
+	LogoURL           string
+	HistoryLength     int
+	ReliabilityWindow int
+	SSEMaxClients     int
+	RefreshInterval   time.Duration
+	LiveUpdates       bool
+	RenderCacheTTL    time.Duration
+	SSEMaxAge         time.Duration
+	MaxServers        int
+	QueriesPerIP      int
+	QueryPayload      string
+	Pinned            string
+	TagsFile          string
+	ReverseDNS        bool
+	MasterCompat      string
+	ListOrder         string
+	AllowedGames      string
+	WebhookURL        string
+	QueryBridge       string
+	SOCKS5            string
+	Upstream          string
+	UpstreamPoll      time.Duration
+	TLSCert           string
+	TLSKey            string
+	RedirectAddr      string
+	HTTPReadTimeout   time.Duration
+	HTTPWriteTimeout  time.Duration
+	HTTPIdleTimeout   time.Duration
 
-	// 2. 启动后台清理和查询任务
-	go startCleanerAndQuery()
+	HeartbeatRate      time.Duration
+	HeartbeatBurst     int
+	BlackholeThreshold int
+	BlackholeWindow    time.Duration
+	BlackholeDuration  time.Duration
+	CrowdedIPServers   int
 
-	// 3. 启动 Web 服务器 (8080)
-	http.HandleFunc("/", handleWeb)
-	log.Println("Web Server started on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	MasterQueryRate  time.Duration
+	MasterQueryBurst int
+	MasterChallenge  bool
 }
 
-// startUDPServer 处理来自游戏服务器的心跳包
-func startUDPServer() {
-	addr, _ := net.ResolveUDPAddr("udp", ":27010")
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		log.Fatalf("UDP Listen error: %v", err)
+var config Config
+
+// parseFlags 解析命令行参数，默认值与之前写死的数值一致
+func parseFlags() {
+	flag.StringVar(&config.UDPAddrs, "udp-port", "27010", "Master Server UDP 监听地址，多个用逗号分隔，例如 27010 或 10.0.0.1:27010,[::1]:27010")
+	flag.StringVar(&config.WebAddr, "web-addr", ":8080", "Web 服务监听地址，unix:/path 表示监听 Unix 域套接字")
+	flag.DurationVar(&config.QueryInterval, "query-interval", 30*time.Second, "清理和查询服务器的间隔")
+	flag.DurationVar(&config.ServerTimeout, "server-timeout", 5*time.Minute, "超过该时间未收到心跳的服务器将被移除")
+	flag.DurationVar(&config.QueryTimeout, "query-timeout", 2*time.Second, "A2S 查询等待回复的超时时间")
+	flag.IntVar(&config.QueryWorkers, "query-workers", 50, "同时查询服务器的 worker 数量")
+	flag.DurationVar(&config.HeartbeatRate, "heartbeat-rate", 2*time.Second, "每个来源 IP 每隔多久补充一次心跳配额，0 表示不限制")
+	flag.IntVar(&config.HeartbeatBurst, "heartbeat-burst", 10, "每个来源 IP 允许连续发送的心跳数")
+	flag.IntVar(&config.BlackholeThreshold, "blackhole-threshold", 50, "同一来源 IP 在 -blackhole-window 内发送的无效数据包达到该数量时临时屏蔽，0 表示不屏蔽")
+	flag.DurationVar(&config.BlackholeWindow, "blackhole-window", time.Minute, "统计无效数据包的时间窗口")
+	flag.DurationVar(&config.BlackholeDuration, "blackhole-duration", 10*time.Minute, "屏蔽的时长，期间丢弃该 IP 的所有数据包")
+	flag.IntVar(&config.CrowdedIPServers, "crowded-ip-servers", 20, "同一 IP 上的服务器数达到该值时在 /stats 的 crowdedIPs 中列出，便于发现刷列表的行为，0 表示不检查")
+	flag.DurationVar(&config.MasterQueryRate, "master-query-rate", time.Second, "每个来源 IP 每隔多久补充一次列表请求配额，0 表示不限制")
+	flag.IntVar(&config.MasterQueryBurst, "master-query-burst", 20, "每个来源 IP 允许连续发送的列表请求数 (分页拉取时每页一个)")
+	flag.BoolVar(&config.MasterChallenge, "master-challenge", false, "列表请求需先取得 challenge 并以 \\challenge\\<值> 附在过滤字符串中，防止伪造来源的反射攻击；开启后不接受旧版 'c' 请求")
+	flag.StringVar(&config.QueryPayload, "query-payload", defaultQueryPayload, "A2S_INFO 请求中的负载字符串，发送时自动补上结尾的 0x00")
+	flag.IntVar(&config.QueriesPerIP, "queries-per-ip", 1, "同一 IP 同时进行的查询数，避免触发服务器主机的 UDP 限速，0 表示不限制")
+	flag.StringVar(&config.Upstream, "upstream-master", "", "上游 Master 地址 (host:port)，设置后转发收到的心跳并定期拉取上游的服务器列表")
+	flag.DurationVar(&config.UpstreamPoll, "upstream-poll-interval", 2*time.Minute, "拉取上游服务器列表的间隔，应小于 -server-timeout，0 表示只转发不拉取")
+	flag.StringVar(&config.SOCKS5, "socks5", "", "SOCKS5 代理地址 [user:pass@]host:port，设置后 A2S 查询通过代理的 UDP ASSOCIATE 转发，为空时直接发送 UDP")
+	flag.StringVar(&config.QueryBridge, "query-bridge-url", "", "A2S HTTP 桥接地址，设置后所有 A2S 查询通过 HTTP POST 由桥接转发，为空时直接发送 UDP")
+	flag.IntVar(&config.QueryRetries, "query-retries", 2, "A2S_INFO 查询失败后的重试次数")
+	flag.IntVar(&config.EmptyQueryEvery, "empty-query-every", 3, "没有玩家的服务器每隔几轮查询一次，有玩家的服务器每轮都查询，1 表示全部每轮查询")
+	flag.IntVar(&config.MaxServers, "max-servers", 0, "最多记录的服务器数量，已满时拒绝新服务器，0 表示不限制")
+	flag.IntVar(&config.MaxQueryFails, "max-query-fails", 10, "连续查询失败达到该次数的服务器将被移除，0 表示不移除")
+	flag.DurationVar(&config.QueryFailTimeout, "query-fail-timeout", 0, "持续发送心跳、但超过该时间没有成功响应 A2S_INFO 的服务器将被移除，从未成功时从首次注册算起，0 表示不按时间移除")
+	flag.BoolVar(&config.HidePending, "hide-pending", false, "网页和 API 中隐藏尚未通过 A2S_INFO 验证的服务器")
+	flag.BoolVar(&config.AllowPrivate, "allow-private", false, "接受来自私有网络、回环和链路本地地址的心跳，局域网部署时使用")
+	flag.BoolVar(&config.HideEmpty, "hide-empty", false, "Master 列表、网页和 API 中隐藏没有真人玩家 (只有机器人或空服) 的服务器")
+	flag.IntVar(&config.MinRealPlayers, "min-real-players", 0, "真人玩家 (人数减去机器人) 少于该数量的服务器同样隐藏，0 表示不限制")
+	flag.StringVar(&config.GeoIPDB, "geoip-db", "", "MaxMind GeoLite2 Country/City 数据库路径，为空时不解析国家")
+	flag.StringVar(&config.StateFile, "state-file", "", "服务器列表快照文件路径，为空时不保存")
+	flag.StringVar(&config.BanFile, "ban-file", "", "封禁列表文件路径，每次封禁或解封后写入，启动时读取；为空时重启后封禁失效")
+	flag.StringVar(&config.JSONTimeFormat, "json-time-format", "rfc3339", "API 中服务器时间字段 (firstSeen、lastSeen 等) 的格式: rfc3339 字符串, unix 秒时间戳, unixms 毫秒时间戳；内置页面使用的 /events 不受影响")
+	flag.StringVar(&config.JSONFieldNames, "json-field-names", "camel", "API 中服务器信息的字段名风格: camel (maxPlayers), snake (max_players)；内置页面使用的 /events 不受影响")
+	flag.StringVar(&config.LogLevel, "log-level", "info", "日志级别: debug, info, warn, error")
+	flag.StringVar(&config.MasterCompat, "master-compat", "auto", "服务器列表回复格式: auto 按请求识别, modern 总是用 'f' 格式, legacy 总是用旧版 'd' 格式")
+	flag.StringVar(&config.ListOrder, "list-order", "address", "Master 列表中服务器的顺序: address 按地址, lastseen 最近心跳优先, random 每次请求随机排列, least-populated-first 人数少的优先")
+	flag.StringVar(&config.AllowedGames, "allowed-games", "", "只收录这些游戏目录的服务器，逗号分隔，例如 cstrike,czero；为空时不限制")
+	flag.StringVar(&config.TLSCert, "tls-cert", "", "HTTPS 证书文件，与 -tls-key 同时设置时 Web 服务使用 HTTPS")
+	flag.StringVar(&config.TLSKey, "tls-key", "", "HTTPS 私钥文件")
+	flag.StringVar(&config.RedirectAddr, "http-redirect-addr", "", "启用 HTTPS 时额外监听的 HTTP 地址，所有请求重定向到 HTTPS，例如 :80")
+	flag.DurationVar(&config.HTTPReadTimeout, "http-read-timeout", 10*time.Second, "Web 服务读取整个请求 (含请求头和请求体) 的超时，0 表示不限制")
+	flag.DurationVar(&config.HTTPWriteTimeout, "http-write-timeout", 30*time.Second, "Web 服务写出响应的超时，/events 和 /api/stream 等长连接按每次写入单独计算，0 表示不限制")
+	flag.DurationVar(&config.HTTPIdleTimeout, "http-idle-timeout", 2*time.Minute, "keep-alive 连接空闲多久后关闭，0 表示与 -http-read-timeout 相同")
+	flag.StringVar(&config.WebhookURL, "webhook-url", "", "服务器上线/下线时 POST JSON 事件的地址，为空时不发送")
+	flag.DurationVar(&config.RefreshInterval, "refresh-interval", 10*time.Second, "列表页自动刷新的间隔；开启 -live-updates 时只在浏览器不支持或无法连接 SSE 时使用，0 表示不刷新")
+	flag.DurationVar(&config.RenderCacheTTL, "render-cache-ttl", time.Second, "首页和 /api/servers 渲染结果的缓存时间，同一 URL 的突发请求共用一次渲染，列表变化时立即失效；0 表示不缓存")
+	flag.BoolVar(&config.LiveUpdates, "live-updates", true, "列表页通过 /events (SSE) 实时更新，关闭后按 -refresh-interval 整页刷新")
+	flag.IntVar(&config.SSEMaxClients, "sse-max-clients", 1000, "同时连接 /events 的最大客户端数，超出时返回 503，0 表示不限制")
+	flag.DurationVar(&config.SSEMaxAge, "sse-max-age", 30*time.Minute, "单个 /events 连接的最长时间，到期后通知浏览器重连，0 表示不限制")
+	flag.IntVar(&config.ReliabilityWindow, "reliability-window", 20, "按最近多少次 A2S_INFO 查询计算成功率和可靠性等级 (1-64)")
+	flag.IntVar(&config.HistoryLength, "history-length", 120, "每个服务器保留的人数采样数量 (按 -query-interval 采样)，0 表示不记录")
+	flag.BoolVar(&config.ReverseDNS, "reverse-dns", false, "后台反向解析服务器 IP，在地址上以提示显示主机名")
+	flag.StringVar(&config.TagsFile, "tags", "", "服务器标签文件，每行一个 \"ip:port 标签1,标签2\"，# 开头为注释；标签显示在网页中并可用 ?tag= 筛选")
+	flag.StringVar(&config.Pinned, "pinned", "", "置顶的服务器地址，逗号分隔，例如 1.2.3.4:27015,5.6.7.8:27016")
+	flag.StringVar(&config.Template, "template", "", "替换首页的外部模板文件 (html/template 语法，数据与内置模板相同)，为空时使用内置模板")
+	flag.StringVar(&config.SiteTitle, "site-title", "", "页面标题和首页标题中显示的站点名称，为空时使用默认名称")
+	flag.StringVar(&config.LogoURL, "logo-url", "", "首页标题前显示的标志图片地址")
+	flag.StringVar(&config.CORSOrigin, "cors-origin", "", "允许跨域访问 JSON API 的来源，逗号分隔，例如 https://example.com，* 表示任意来源；为空时不输出 CORS 头")
+	flag.StringVar(&config.AdminToken, "admin-token", "", "管理接口 /admin/* 的访问令牌，为空时禁用管理接口")
+	flag.Parse()
+}
+
+// setupLogger 按 -log-level 设置默认的 slog 日志输出
+func setupLogger(levelName string) error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(levelName)); err != nil {
+		return fmt.Errorf("invalid log level %q", levelName)
 	}
-	defer conn.Close()
-	log.Println("Master Server (UDP) listening on :27010")
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+	return nil
+}
 
-	buf := make([]byte, 1024)
-	for {
-		n, remoteAddr, err := conn.ReadFromUDP(buf)
+// 按地图分组页模板
+const byMapTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>按地图 - {{ or siteTitle "CS 1.6 Server List" }}</title>
+    <link href="/static/style.css" rel="stylesheet">
+</head>
+<body>
+    <div class="container">
+        <p><a href="/">&larr; 返回列表</a></p>
+        <h2 class="mb-4">按地图分组</h2>
+        {{ range . }}
+        <h5 class="mt-4">{{ .Map }} <span class="text-muted small">{{ len .Servers }} 个服务器，{{ .Players }} 名玩家</span></h5>
+        <table class="table table-sm table-striped border">
+            <tbody>
+                {{ range .Servers }}
+                <tr>
+                    <td><a href="/server?addr={{ .Address }}">{{ .Name }}</a></td>
+                    <td>{{ .Address }}</td>
+                    <td>{{ .Players }}/{{ .MaxPlayers }}</td>
+                    <td>{{ if .CountryCode }}<span title="{{ .Country }}">{{ .Flag }} {{ .CountryCode }}</span>{{ end }}</td>
+                </tr>
+                {{ end }}
+            </tbody>
+        </table>
+        {{ else }}
+        <div class="alert alert-info">暂无服务器</div>
+        {{ end }}
+    </div>
+</body>
+</html>
+`
+
+// 服务器详情页模板
+const detailTemplate = `
+<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{ .Name }} - {{ or siteTitle "CS 1.6 Server List" }}</title>
+    <link href="/static/style.css" rel="stylesheet">
+</head>
+<body>
+    <div class="container">
+        <p><a href="/">&larr; 返回列表</a></p>
+        <h2 class="mb-4">{{ .Name }}</h2>
+        <table class="table border">
+            <tbody>
+                <tr><th>地址</th><td>{{ .Address }}{{ if .Hostname }} ({{ .Hostname }}){{ end }}</td></tr>
+                <tr><th>地图</th><td>{{ .Map }}</td></tr>
+                <tr><th>游戏</th><td>{{ .GameDesc }}{{ if .GameDir }} ({{ .GameDir }}){{ end }}</td></tr>
+                <tr><th>人数</th><td>{{ .Players }}/{{ .MaxPlayers }}{{ if .Bots }} ({{ .Bots }} 机器人){{ end }}</td></tr>
+                <tr><th>峰值人数</th><td>{{ if not .PeakPlayersTime.IsZero }}今日 {{ .PeakPlayers }} ({{ .PeakPlayersTime.Format "15:04" }})，历史 {{ .AllTimePeak }} ({{ .AllTimePeakTime.Format "2006-01-02 15:04" }}){{ end }}</td></tr>
+                <tr><th>国家</th><td>{{ if .CountryCode }}{{ .Flag }} {{ .Country }} ({{ .CountryCode }}){{ end }}</td></tr>
+                <tr><th>区域</th><td>{{ .RegionName }}</td></tr>
+                <tr><th>系统</th><td>{{ .OS }}</td></tr>
+                <tr><th>VAC</th><td>{{ if .Secure }}是{{ else }}否{{ end }}</td></tr>
+                <tr><th>密码</th><td>{{ if .Passworded }}是{{ else }}否{{ end }}</td></tr>
+                <tr><th>版本</th><td>{{ .Version }}{{ if .Protocol }} (协议 {{ .Protocol }}){{ end }}</td></tr>
+                <tr><th>引擎</th><td>{{ if eq .Engine "goldsrc" }}GoldSrc{{ else if eq .Engine "source" }}Source{{ else }}-{{ end }}</td></tr>
+                <tr><th>App ID</th><td>{{ if .GameID }}{{ .GameID }}{{ else }}-{{ end }}</td></tr>
+                <tr><th>标签</th><td>{{ range .Tags }}<a class="badge bg-info text-decoration-none me-1" href="/?tag={{ . }}">{{ . }}</a>{{ else }}-{{ end }}</td></tr>
+                <tr><th>关键字</th><td>{{ range .Keywords }}<span class="badge bg-secondary me-1">{{ . }}</span>{{ end }}</td></tr>
+                <tr><th>延迟</th><td>{{ if .Ping }}{{ .Ping.Milliseconds }} ms{{ end }}</td></tr>
+                <tr><th>首次出现</th><td>{{ .FirstSeen.Format "2006-01-02 15:04:05" }} (已在线 {{ .UptimeText }})</td></tr>
+                <tr><th>最后更新</th><td>{{ .LastSeen.Format "2006-01-02 15:04:05" }}</td></tr>
+                <tr><th>来源</th><td>{{ if eq .Source "upstream" }}上游 Master{{ else }}心跳{{ end }}</td></tr>
+                <tr><th>最近查询</th><td>{{ if not .LastQueryTime.IsZero }}{{ .LastQueryTime.Format "2006-01-02 15:04:05" }}{{ end }}{{ if .FailCount }} (连续失败 {{ .FailCount }} 次){{ end }}</td></tr>
+                <tr><th>最近成功</th><td>{{ if not .LastQuerySuccess.IsZero }}{{ .LastQuerySuccess.Format "2006-01-02 15:04:05" }}{{ else }}从未{{ end }}{{ if .Unresponsive }} <span class="badge bg-warning">无响应</span>{{ end }}</td></tr>
+                <tr><th>可靠性</th><td>{{ if .Grade }}<span class="badge {{ .GradeClass }}">{{ .Grade }}</span> 最近查询成功率 {{ .Reliability }}%{{ else }}-{{ end }}</td></tr>
+                <tr><th>查询错误</th><td>{{ if .LastError }}<span class="text-danger">{{ .LastError }}</span>{{ else }}-{{ end }}</td></tr>
+            </tbody>
+        </table>
+        <h4 class="mt-4">玩家 ({{ len .PlayerList }})</h4>
+        {{ if .PlayerList }}
+        <table class="table table-striped table-sm border">
+            <thead class="table-dark"><tr><th>名称</th><th>得分</th><th>在线时长</th></tr></thead>
+            <tbody>
+                {{ range .PlayerList }}
+                <tr><td>{{ .Name }}</td><td>{{ .Score }}</td><td>{{ .DurationText }}</td></tr>
+                {{ end }}
+            </tbody>
+        </table>
+        {{ if not .PlayersUpdated.IsZero }}<div class="text-muted small">更新于 {{ .PlayersUpdated.Format "15:04:05" }}</div>{{ end }}
+        {{ else }}
+        <div class="text-muted">暂无玩家</div>
+        {{ end }}
+        <h4 class="mt-4">最近的人数和延迟</h4>
+        {{ if .Recent }}
+        <table class="table table-striped table-sm border">
+            <thead class="table-dark"><tr><th>时间</th><th>人数</th><th>延迟</th></tr></thead>
+            <tbody>
+                {{ range .Recent }}
+                <tr><td>{{ .Time.Format "15:04:05" }}</td><td>{{ .Players }}</td><td>{{ if .PingMs }}{{ .PingMs }} ms{{ else }}-{{ end }}</td></tr>
+                {{ end }}
+            </tbody>
+        </table>
+        <div class="text-muted small">完整记录见 <a href="/api/history?addr={{ .Address }}">/api/history</a></div>
+        {{ else }}
+        <div class="text-muted">暂无数据</div>
+        {{ end }}
+        <h4 class="mt-4">服务器参数</h4>
+        {{ if .Rules }}
+        <table class="table table-striped table-sm border">
+            <thead class="table-dark"><tr><th>名称</th><th>值</th></tr></thead>
+            <tbody>
+                {{ range $name, $value := .Rules }}
+                <tr><td>{{ $name }}</td><td>{{ $value }}</td></tr>
+                {{ end }}
+            </tbody>
+        </table>
+        <div class="text-muted small">更新于 {{ .RulesUpdated.Format "15:04:05" }}</div>
+        {{ else }}
+        <div class="text-muted">暂无数据</div>
+        {{ end }}
+    </div>
+</body>
+</html>
+`
+
+func main() {
+	parseFlags()
+	if err := setupLogger(config.LogLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	switch config.MasterCompat {
+	case "auto", "modern", "legacy":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -master-compat %q\n", config.MasterCompat)
+		os.Exit(2)
+	}
+	switch config.JSONTimeFormat {
+	case "rfc3339", "unix", "unixms":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -json-time-format %q\n", config.JSONTimeFormat)
+		os.Exit(2)
+	}
+	switch config.JSONFieldNames {
+	case "camel", "snake":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -json-field-names %q\n", config.JSONFieldNames)
+		os.Exit(2)
+	}
+	switch config.ListOrder {
+	case "address", "lastseen", "random", "least-populated-first":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid -list-order %q\n", config.ListOrder)
+		os.Exit(2)
+	}
+	if config.ReliabilityWindow < 1 || config.ReliabilityWindow > 64 {
+		fmt.Fprintf(os.Stderr, "invalid -reliability-window %d: must be between 1 and 64\n", config.ReliabilityWindow)
+		os.Exit(2)
+	}
+	if config.EmptyQueryEvery < 1 {
+		fmt.Fprintf(os.Stderr, "invalid -empty-query-every %d: must be at least 1\n", config.EmptyQueryEvery)
+		os.Exit(2)
+	}
+	if (config.TLSCert == "") != (config.TLSKey == "") {
+		fmt.Fprintln(os.Stderr, "-tls-cert and -tls-key must be set together")
+		os.Exit(2)
+	}
+	useTLS := config.TLSCert != ""
+	query, err := buildInfoQuery(config.QueryPayload)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -query-payload: %v\n", err)
+		os.Exit(2)
+	}
+	infoQuery = query
+	if config.Template != "" {
+		tmpl, err := template.New(filepath.Base(config.Template)).Funcs(templateFuncs).ParseFiles(config.Template)
 		if err != nil {
-			continue
+			fmt.Fprintf(os.Stderr, "invalid -template: %v\n", err)
+			os.Exit(2)
+		}
+		listTmpl = tmpl
+	}
+	if config.QueryBridge != "" {
+		if u, err := url.Parse(config.QueryBridge); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fmt.Fprintf(os.Stderr, "invalid -query-bridge-url %q\n", config.QueryBridge)
+			os.Exit(2)
+		}
+	}
+	if config.SOCKS5 != "" {
+		if config.QueryBridge != "" {
+			fmt.Fprintln(os.Stderr, "-socks5 and -query-bridge-url cannot be used together")
+			os.Exit(2)
 		}
-		// HLDS 发送的心跳包通常包含 'q' 或 '1' (0x31) 等字节
-		if n > 0 {
-			registerServer(remoteAddr.String())
+		if _, _, hostport := parseSOCKS5(config.SOCKS5); hostport == "" {
+			fmt.Fprintf(os.Stderr, "invalid -socks5 %q\n", config.SOCKS5)
+			os.Exit(2)
 		}
 	}
-}
 
-// registerServer 注册或更新服务器
-func registerServer(address string) {
-	manager.mu.Lock()
-	defer manager.mu.Unlock()
+	// 收到 SIGINT/SIGTERM 时取消 ctx，各后台任务随之退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
 
-	if s, exists := manager.servers[address]; exists {
-		s.LastSeen = time.Now()
-	} else {
-		log.Printf("New server detected: %s", address)
-		manager.servers[address] = &ServerInfo{
-			Address:  address,
-			LastSeen: time.Now(),
-			Name:     "Scanning...",
+	if config.GeoIPDB != "" {
+		db, err := openGeoDB(config.GeoIPDB)
+		if err != nil {
+			slog.Warn("GeoIP database not loaded", "path", config.GeoIPDB, "err", err)
+		} else {
+			geoip = db
+			slog.Info("GeoIP database loaded", "path", config.GeoIPDB)
 		}
 	}
-}
-
-// handleWeb 处理网页请求
-func handleWeb(w http.ResponseWriter, r *http.Request) {
-	manager.mu.RLock()
-	defer manager.mu.RUnlock()
 
-	var list []*ServerInfo
-	for _, s := range manager.servers {
-		list = append(list, s)
+	pinnedServers = parsePinned(config.Pinned)
+	if config.TagsFile != "" {
+		tags, err := loadTags(config.TagsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -tags: %v\n", err)
+			os.Exit(2)
+		}
+		serverTags = tags
 	}
-	// 排序
-	sort.Slice(list, func(i, j int) bool {
-		return list[i].LastSeen.After(list[j].LastSeen)
-	})
 
-	data := struct {
-		Count   int
-		Servers []*ServerInfo
-	}{
-		Count:   len(list),
-		Servers: list,
+	// 先恢复封禁列表，再恢复服务器列表
+	if config.BanFile != "" {
+		loadBans(config.BanFile)
+	}
+	// 恢复上次保存的服务器列表
+	if config.StateFile != "" {
+		loadState(config.StateFile, config.ServerTimeout)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			startStateSaver(ctx, config.StateFile, config.QueryInterval)
+		}()
 	}
 
-	tmpl, _ := template.New("list").Parse(htmlTemplate)
-	tmpl.Execute(w, data)
-}
+	heartbeatLimiter = newRateLimiter(config.HeartbeatRate, config.HeartbeatBurst)
+	challengeLimiter = newRateLimiter(config.HeartbeatRate, config.HeartbeatBurst)
+	scanners = newScannerGuard(config.BlackholeThreshold, config.BlackholeWindow, config.BlackholeDuration)
+	masterQueryLimiter = newRateLimiter(config.MasterQueryRate, config.MasterQueryBurst)
+	allowedGames = parseGameList(config.AllowedGames)
 
-// startCleanerAndQuery 定期清理离线服务器并查询在线服务器详情
-func startCleanerAndQuery() {
-	ticker := time.NewTicker(30 * time.Second) // 每30秒检查一次
-	for range ticker.C {
-		manager.mu.Lock()
-		// 复制一份需要处理的服务器地址，释放锁后再去查询网络，防止阻塞
-		var checkList []string
-		
-		for addr, s := range manager.servers {
-			// 1. 删除超过 5 分钟未发送心跳的服务器
-			if time.Since(s.LastSeen) > 5*time.Minute {
-				delete(manager.servers, addr)
-				log.Printf("Server removed (timeout): %s", addr)
-				continue
-			}
-			checkList = append(checkList, addr)
-		}
-		manager.mu.Unlock()
+	if config.ReverseDNS {
+		rdns = newReverseDNS()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rdns.run(ctx, rdnsWorkers)
+		}()
+	}
 
-		// 2. 查询服务器详情 (A2S_INFO) - 并发查询
-		for _, addr := range checkList {
-			go func(targetAddr string) {
-				queryServerDetails(targetAddr)
-			}(addr)
+	if config.Upstream != "" {
+		raddr, err := net.ResolveUDPAddr("udp", config.Upstream)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "invalid -upstream-master: %v\n", err)
+			os.Exit(2)
 		}
+		upstream = newUpstreamMaster(raddr)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			upstream.runRelay(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			upstream.runPoll(ctx, config.UpstreamPoll)
+		}()
+	}
+
+	// 在启动 UDP 监听前订阅，不漏掉第一批服务器
+	if config.WebhookURL != "" {
+		ch := events.Subscribe(webhookQueueSize)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runWebhook(ctx, config.WebhookURL, ch)
+		}()
 	}
-}
 
-// queryServerDetails 发送 A2S_INFO 查询
-func queryServerDetails(address string) {
-	conn, err := net.DialTimeout("udp", address, 3*time.Second)
+	// 1. 启动 UDP Master Server 监听，每个地址一个 goroutine，共用同一个服务器列表
+	for _, bind := range splitBindSpecs(config.UDPAddrs) {
+		bind := bind
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			startUDPServer(ctx, bind)
+		}()
+	}
+
+	// 2. 启动后台清理和查询任务，/api/query 等接口的即时查询也交给同一个 worker 池
+	queries = newQueryPool(ctx, config.QueryWorkers, config.QueriesPerIP, config.QueryTimeout)
+	queries.onIdle = queryCycle.finish
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		startCleanerAndQuery(ctx, queries, config.QueryInterval, config.ServerTimeout)
+	}()
+
+	// 3. 启动 Web 服务器
+	http.HandleFunc("/", withGzip(withRenderCache(handleWeb)))
+	http.HandleFunc("/api/servers", withCORS(withGzip(withRenderCache(handleAPIServers))))
+	http.HandleFunc("/api/players", withCORS(withGzip(handleAPIPlayers)))
+	http.HandleFunc("/api/history", withCORS(withGzip(handleAPIHistory)))
+	http.HandleFunc("/api/raw", withCORS(withGzip(handleAPIRaw)))
+	http.HandleFunc("/api/list.txt", withCORS(withGzip(handleAPIListText)))
+	http.HandleFunc("/api/query", withCORS(withGzip(handleAPIQuery)))
+	http.HandleFunc("/api/verify", withCORS(handleAPIVerify))
+	http.HandleFunc("/server", withGzip(handleServerDetail))
+	http.HandleFunc("/by-map", withGzip(handleByMap))
+	http.HandleFunc("/api/by-map", withCORS(withGzip(handleAPIByMap)))
+	http.HandleFunc("/healthz", handleHealthz)
+	http.Handle("/static/", http.FileServer(http.FS(staticFS)))
+	http.HandleFunc("/favicon.ico", handleFavicon)
+	http.HandleFunc("/stats", withCORS(withGzip(handleStats)))
+	http.HandleFunc("/events", withCORS(handleEvents))
+	http.HandleFunc("/api/stream", withCORS(handleStream))
+	http.HandleFunc("/api/events", withCORS(withGzip(handleAPIEvents)))
+	http.HandleFunc("/admin/remove", requireAdmin(handleAdminRemove, http.MethodPost))
+	http.HandleFunc("/admin/ban", requireAdmin(handleAdminBan, http.MethodPost))
+	http.HandleFunc("/admin/bans", requireAdmin(handleAdminBans, http.MethodGet, http.MethodDelete))
+	http.HandleFunc("/admin/raw-query", requireAdmin(handleAdminRawQuery, http.MethodGet))
+	http.HandleFunc("/admin/blackhole", requireAdmin(handleAdminBlackhole, http.MethodGet, http.MethodDelete))
+	// 请求的 ctx 继承自 ctx，关闭时 SSE 等长连接随之结束。
+	// 超时防止慢速客户端长期占用连接，长连接在每次写入前自行延长写入截止时间
+	srv := &http.Server{
+		Addr:         config.WebAddr,
+		BaseContext:  func(net.Listener) context.Context { return ctx },
+		ReadTimeout:  config.HTTPReadTimeout,
+		WriteTimeout: config.HTTPWriteTimeout,
+		IdleTimeout:  config.HTTPIdleTimeout,
+	}
+	ln, err := listenWeb(config.WebAddr)
 	if err != nil {
-		return
+		slog.Error("Web server failed", "addr", config.WebAddr, "err", err)
+		os.Exit(1)
 	}
-	defer conn.Close()
+	go func() {
+		slog.Info("Web server started", "addr", config.WebAddr, "tls", useTLS)
+		var err error
+		if useTLS {
+			err = srv.ServeTLS(ln, config.TLSCert, config.TLSKey)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Web server failed", "addr", config.WebAddr, "err", err)
+			os.Exit(1)
+		}
+	}()
 
-	// A2S_INFO Header: 0xFF 0xFF 0xFF 0xFF + 'T' + Payload
-	query := []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x54, 0x53, 0x6F, 0x75, 0x72, 0x63, 0x65, 0x20, 0x45, 0x6E, 0x67, 0x69, 0x6E, 0x65, 0x20, 0x51, 0x75, 0x65, 0x72, 0x79, 0x00}
-	conn.Write(query)
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	// 可选的 HTTP 监听，只负责把请求重定向到 HTTPS
+	var redirectSrv *http.Server
+	if useTLS && config.RedirectAddr != "" {
+		redirectSrv = &http.Server{
+			Addr:         config.RedirectAddr,
+			Handler:      httpsRedirect(config.WebAddr),
+			ReadTimeout:  config.HTTPReadTimeout,
+			WriteTimeout: config.HTTPWriteTimeout,
+			IdleTimeout:  config.HTTPIdleTimeout,
+		}
+		go func() {
+			slog.Info("HTTP redirect server started", "addr", config.RedirectAddr)
+			if err := redirectSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP redirect server failed", "addr", config.RedirectAddr, "err", err)
+			}
+		}()
+	}
 
-	resp := make([]byte, 1400)
-	n, err := conn.Read(resp)
-	if err != nil || n < 5 {
-		return
+	<-ctx.Done()
+	slog.Info("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if redirectSrv != nil {
+		redirectSrv.Shutdown(shutdownCtx)
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Web server shutdown incomplete", "err", err)
+	}
+	if path, ok := strings.CutPrefix(config.WebAddr, "unix:"); ok {
+		os.Remove(path)
 	}
+	wg.Wait()
 
-	// 解析简单的 GoldSrc/Source 响应 (跳过 Header)
-	buffer := bytes.NewBuffer(resp[5:]) // Skip FFFFFFFF + Header
-	
-	readString := func(b *bytes.Buffer) string {
-		str, _ := b.ReadString(0x00)
-		if len(str) > 0 {
-			return str[:len(str)-1]
+	// 所有写入方都已停止，最后保存一次
+	if config.StateFile != "" {
+		if err := saveState(config.StateFile); err != nil {
+			slog.Error("Saving state failed", "path", config.StateFile, "err", err)
 		}
-		return ""
 	}
+	slog.Info("Shutdown complete")
+}
 
-	// 协议格式通常为: Protocol, Name, Map, Folder, Game, ID, Players, MaxPlayers...
-	// 防止 buffer 溢出 panic
-	defer func() {
-		if r := recover(); r != nil {
-			// 忽略解析错误
+// listenWeb 按 -web-addr 创建 Web 监听，"unix:" 前缀表示 Unix 域套接字。
+// 上次异常退出留下的套接字文件会先被删除，其他类型的文件则保留并报错。
+func listenWeb(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
 		}
-	}()
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
 
-	_ = buffer.Next(1) // Protocol version
-	name := readString(buffer)
-	mapName := readString(buffer)
-	_ = readString(buffer) // Folder
-	_ = readString(buffer) // Game
-	_ = buffer.Next(2)     // ID
-	
-	// 简单的长度检查
-	if buffer.Len() < 2 {
-		return
-	}
-	players := int(buffer.Next(1)[0])
-	maxPlayers := int(buffer.Next(1)[0])
-
-	manager.mu.Lock()
-	// 再次检查是否存在，避免并发删除问题
-	if target, ok := manager.servers[address]; ok {
-		target.Name = name
-		target.Map = mapName
-		target.Players = players
-		target.MaxPlayers = maxPlayers
-	}
-	manager.mu.Unlock()
+// httpsRedirect 把请求永久重定向到同一主机的 HTTPS 地址，
+// HTTPS 不在 443 端口时沿用 webAddr 中的端口
+func httpsRedirect(webAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(webAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// loadState 从快照文件恢复服务器列表，丢弃已超时的条目。
+// 文件不存在或损坏时记录警告并以空列表启动。
+func loadState(path string, maxAge time.Duration) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		slog.Warn("State file not loaded, starting empty", "path", path, "err", err)
+		return
+	}
+	var list []*ServerInfo
+	if err := json.Unmarshal(data, &list); err != nil {
+		slog.Warn("State file is corrupt, starting empty", "path", path, "err", err)
+		return
+	}
+
+	for _, s := range list {
+		if s.Address == "" || time.Since(s.LastSeen) > maxAge || isBanned(s.Address) {
+			continue
+		}
+		if s.Family == "" {
+			s.Family = addressFamily(s.Address)
+		}
+		if s.FirstSeen.IsZero() {
+			s.FirstSeen = s.LastSeen
+		}
+		// 按当前的数据库重新计算，旧快照中没有区域字段
+		resolveCountry(s)
+		s.Pinned = pinnedServers[s.Address]
+		s.Offline = false
+		// 查询记录不保存在快照中，成功率从重启后的查询重新统计
+		s.Reliability = 0
+		// 标签文件中有记录时以文件为准，否则保留快照中的标签
+		if tags, ok := serverTags[s.Address]; ok {
+			s.Tags = tags
+		}
+		manager.Add(s, 0)
+	}
+	slog.Info("Restored servers from state file", "count", manager.Len(), "path", path)
+}
+
+// stateServer 快照文件中的服务器记录，不经过 ServerInfo.MarshalJSON，
+// 时间字段总是 RFC 3339 格式，不受 -json-time-format 影响，loadState 可以直接读回
+type stateServer ServerInfo
+
+// saveState 将服务器列表写入快照文件，先写临时文件再重命名，避免写一半的文件
+func saveState(path string) error {
+	list := snapshotServers()
+	records := make([]*stateServer, len(list))
+	for i, s := range list {
+		records[i] = (*stateServer)(s)
+	}
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// startStateSaver 定期保存服务器列表
+func startStateSaver(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := saveState(path); err != nil {
+				slog.Error("Saving state failed", "path", path, "err", err)
+			}
+		}
+	}
+}
+
+// splitBindSpecs 拆分 -udp-port 的逗号分隔列表，只有端口号时监听所有地址
+func splitBindSpecs(s string) []string {
+	var binds []string
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		if _, err := strconv.Atoi(spec); err == nil {
+			spec = ":" + spec
+		}
+		binds = append(binds, spec)
+	}
+	return binds
+}
+
+// startUDPServer 在 bind (host:port) 上处理来自游戏服务器的心跳包
+func startUDPServer(ctx context.Context, bind string) {
+	// 不指定 IP 时监听 IPv4 和 IPv6 双栈，IPv4 来源地址仍以 a.b.c.d:port 形式出现
+	laddr, err := net.ResolveUDPAddr("udp", bind)
+	if err != nil {
+		slog.Error("UDP listen failed", "addr", bind, "err", err)
+		return
+	}
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		// 不退出进程，其他地址照常监听；全部失败时由 /healthz 返回 503
+		slog.Error("UDP listen failed", "addr", bind, "err", err)
+		return
+	}
+	defer conn.Close()
+	udpListeners.Add(1)
+	defer udpListeners.Add(-1)
+	slog.Info("Master server (UDP) listening", "addr", conn.LocalAddr().String())
+
+	// 关闭连接以打断阻塞中的 ReadFromUDP
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	buf := make([]byte, 1024)
+	failures := 0
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			// 套接字已关闭时不可能恢复，继续读只会空转
+			if errors.Is(err, net.ErrClosed) {
+				slog.Error("UDP listener closed unexpectedly", "addr", bind, "err", err)
+				return
+			}
+			// 其他错误 (ICMP 导致的 ECONNREFUSED、ENOBUFS 等) 视为暂时性的，连续出错时逐步退避
+			failures++
+			if failures == 1 || failures%100 == 0 {
+				slog.Warn("UDP read failed", "addr", bind, "err", err, "consecutive", failures)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(udpReadBackoff(failures)):
+			}
+			continue
+		}
+		failures = 0
+		dispatchPacket(conn, remoteAddr, buf[:n])
+	}
+}
+
+// udpReadBackoff 第 failures 次连续读取失败后的等待时间，第一次立即重试，之后从 10ms 翻倍，最长 1s
+func udpReadBackoff(failures int) time.Duration {
+	if failures <= 1 {
+		return 0
+	}
+	d := 10 * time.Millisecond
+	for i := 2; i < failures && d < time.Second; i++ {
+		d *= 2
+	}
+	if d > time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// 主端口上的数据包类型 (首字节)
+const (
+	opChallengeRequest = 0x71 // 'q' 服务器请求 challenge
+	opHeartbeat        = 0x30 // '0' 服务器心跳
+	opShutdown         = 0x62 // 'b' 服务器正常关闭前的最后一次通知
+	opMasterQuery      = 0x31 // '1' 客户端请求服务器列表
+	opLegacyQuery      = 0x63 // 'c' 旧版 (WON 时代) HL1 客户端请求服务器列表
+)
+
+// connectionless 包前缀 0xFF 0xFF 0xFF 0xFF
+var connectionlessPrefix = []byte{0xFF, 0xFF, 0xFF, 0xFF}
+
+// udpListeners 当前绑定成功的 UDP 监听数量，供 /healthz 使用
+var udpListeners atomic.Int32
+
+// startTime 进程启动时间
+var startTime = time.Now()
+
+// droppedPackets 统计无法识别而被丢弃的数据包
+var droppedPackets atomic.Uint64
+
+// rateLimitedPackets 统计因超出频率限制被丢弃的心跳和列表请求
+var rateLimitedPackets atomic.Uint64
+
+// heartbeatLimiter 按来源 IP 限制心跳频率
+var heartbeatLimiter *rateLimiter
+
+// challengeLimiter 按来源 IP 限制 challenge 请求频率，配额与心跳相同但单独计算，
+// 服务器先请求 challenge 再发心跳时不会用掉自己的心跳配额
+var challengeLimiter *rateLimiter
+
+// masterQueryLimiter 按来源 IP 限制列表请求频率
+var masterQueryLimiter *rateLimiter
+
+// droppedQueryLog 同一来源 IP 的列表请求被丢弃时每分钟最多记录一次日志
+var droppedQueryLog = newRateLimiter(time.Minute, 1)
+
+// malformedQueryLimiter 按来源 IP 限制对格式错误的列表请求的空回复，
+// 每 2 秒一次、最多连续 3 次，防止伪造来源地址借此反射流量
+var malformedQueryLimiter = newRateLimiter(2*time.Second, 3)
+
+// rateLimiter 按 key 独立计数的令牌桶
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	every   time.Duration // 补充一个令牌的间隔
+	burst   float64       // 桶容量
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter 创建令牌桶限速器，every <= 0 时不限速
+func newRateLimiter(every time.Duration, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		every:   every,
+		burst:   float64(burst),
+	}
+}
+
+// Allow 消耗 key 的一个令牌，令牌不足时返回 false
+func (l *rateLimiter) Allow(key string) bool {
+	if l.every <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) / float64(l.every)
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// purge 删除已经补满的令牌桶，避免 map 无限增长
+func (l *rateLimiter) purge() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	for key, b := range l.buckets {
+		if b.tokens+float64(now.Sub(b.last))/float64(l.every) >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// scanners 统计无效数据包并临时屏蔽扫描器，在 main 中按 -blackhole-* 参数创建
+var scanners *scannerGuard
+
+// scannerGuard 按来源 IP 统计窗口内的无效数据包 (空包、未知操作码、格式错误的列表请求、
+// challenge 不正确的心跳)，超过阈值后在一段时间内丢弃该 IP 的所有数据包，
+// 避免端口扫描和滥用的客户端拖慢心跳处理。threshold 为 0 时不启用。
+type scannerGuard struct {
+	mu        sync.Mutex
+	windows   map[string]*invalidWindow
+	blocked   map[string]*blackholeEntry
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+}
+
+// invalidWindow 一个 IP 在当前统计窗口内的无效包数量
+type invalidWindow struct {
+	start time.Time
+	count int
+}
+
+// blackholeEntry 一个被临时屏蔽的 IP
+type blackholeEntry struct {
+	Since   time.Time `json:"since"`
+	Until   time.Time `json:"until"`
+	Packets int       `json:"packets"` // 触发屏蔽时窗口内的无效包数量
+	Dropped uint64    `json:"dropped"` // 屏蔽期间丢弃的数据包数量
+}
+
+// blackholedIP /admin/blackhole 返回的一项
+type blackholedIP struct {
+	IP string `json:"ip"`
+	blackholeEntry
+}
+
+func newScannerGuard(threshold int, window, duration time.Duration) *scannerGuard {
+	return &scannerGuard{
+		windows:   make(map[string]*invalidWindow),
+		blocked:   make(map[string]*blackholeEntry),
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+	}
+}
+
+// Blocked 报告 ip 当前是否被屏蔽，屏蔽中的数据包计入 Dropped
+func (g *scannerGuard) Blocked(ip string) bool {
+	if g.threshold <= 0 {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	e, ok := g.blocked[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(e.Until) {
+		delete(g.blocked, ip)
+		return false
+	}
+	e.Dropped++
+	return true
+}
+
+// Invalid 记录 ip 发来的一个无效数据包，窗口内达到阈值时开始屏蔽
+func (g *scannerGuard) Invalid(ip string) {
+	if g.threshold <= 0 {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	w, ok := g.windows[ip]
+	if !ok || now.Sub(w.start) > g.window {
+		w = &invalidWindow{start: now}
+		g.windows[ip] = w
+	}
+	w.count++
+	if w.count < g.threshold {
+		return
+	}
+	delete(g.windows, ip)
+	g.blocked[ip] = &blackholeEntry{Since: now, Until: now.Add(g.duration), Packets: w.count}
+	slog.Warn("Source blackholed", "ip", ip, "invalid", w.count, "window", g.window, "duration", g.duration)
+}
+
+// List 按 IP 排序返回当前屏蔽的地址
+func (g *scannerGuard) List() []blackholedIP {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	list := make([]blackholedIP, 0, len(g.blocked))
+	for ip, e := range g.blocked {
+		if now.Before(e.Until) {
+			list = append(list, blackholedIP{IP: ip, blackholeEntry: *e})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// Lift 提前解除对 ip 的屏蔽，ip 未被屏蔽时返回 false
+func (g *scannerGuard) Lift(ip string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	_, ok := g.blocked[ip]
+	delete(g.blocked, ip)
+	delete(g.windows, ip)
+	return ok
+}
+
+// purge 清理已过期的窗口和屏蔽
+func (g *scannerGuard) purge() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for ip, w := range g.windows {
+		if now.Sub(w.start) > g.window {
+			delete(g.windows, ip)
+		}
+	}
+	for ip, e := range g.blocked {
+		if now.After(e.Until) {
+			delete(g.blocked, ip)
+		}
+	}
+}
+
+// dispatchPacket 根据首字节把数据包交给对应的处理函数
+func dispatchPacket(conn *net.UDPConn, remoteAddr *net.UDPAddr, data []byte) {
+	if scanners.Blocked(remoteAddr.IP.String()) {
+		return
+	}
+	// connectionless 包去掉前缀后按内部的操作码处理
+	if bytes.HasPrefix(data, connectionlessPrefix) {
+		data = data[len(connectionlessPrefix):]
+	}
+	if len(data) == 0 {
+		droppedPackets.Add(1)
+		scanners.Invalid(remoteAddr.IP.String())
+		return
+	}
+
+	switch data[0] {
+	case opChallengeRequest:
+		// 1 字节的请求换来 10 字节的回复，伪造来源时会被用来反射流量
+		if !challengeLimiter.Allow(remoteAddr.IP.String()) {
+			rateLimitedPackets.Add(1)
+			scanners.Invalid(remoteAddr.IP.String())
+			return
+		}
+		issueChallenge(conn, remoteAddr)
+	case opHeartbeat:
+		if !heartbeatLimiter.Allow(remoteAddr.IP.String()) {
+			rateLimitedPackets.Add(1)
+			return
+		}
+		handleHeartbeat(remoteAddr, data)
+	case opShutdown:
+		// 与心跳共用频率限制，防止伪造来源反复删除
+		if !heartbeatLimiter.Allow(remoteAddr.IP.String()) {
+			rateLimitedPackets.Add(1)
+			return
+		}
+		deregisterServer(remoteAddr.String())
+	case opMasterQuery, opLegacyQuery:
+		if !masterQueryLimiter.Allow(remoteAddr.IP.String()) {
+			rateLimitedPackets.Add(1)
+			logDroppedQuery(remoteAddr, "rate limited")
+			return
+		}
+		handleMasterQuery(conn, remoteAddr, data)
+	default:
+		droppedPackets.Add(1)
+		scanners.Invalid(remoteAddr.IP.String())
+	}
+}
+
+// challengeTTL challenge 的有效期，服务器需在此时间内发送心跳
+const challengeTTL = 30 * time.Second
+
+// maxPendingChallenges 同时等待验证的 challenge 上限。伪造大量来源地址请求 challenge 时，
+// 清理过期项后仍然占满就不再下发，已注册服务器的心跳不受影响
+const maxPendingChallenges = 65536
+
+// challengeEntry 已下发给服务器的 challenge
+type challengeEntry struct {
+	Value   uint32
+	Expires time.Time
+}
+
+// challenges 按服务器地址保存待验证的 challenge
+var challenges = struct {
+	m  map[string]challengeEntry
+	mu sync.Mutex
+}{
+	m: make(map[string]challengeEntry),
+}
+
+// issueChallenge 生成随机 challenge 并回复 0xFFFFFFFF 's' '\n' <challenge>
+func issueChallenge(conn *net.UDPConn, remoteAddr *net.UDPAddr) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		slog.Error("Challenge generation failed", "err", err)
+		return
+	}
+	value := binary.LittleEndian.Uint32(b[:])
+
+	address := remoteAddr.String()
+	now := time.Now()
+	challenges.mu.Lock()
+	if _, ok := challenges.m[address]; !ok && len(challenges.m) >= maxPendingChallenges {
+		purgeChallengesLocked(now)
+		if len(challenges.m) >= maxPendingChallenges {
+			challenges.mu.Unlock()
+			droppedPackets.Add(1)
+			slog.Debug("Challenge table full", "addr", address)
+			return
+		}
+	}
+	challenges.m[address] = challengeEntry{
+		Value:   value,
+		Expires: now.Add(challengeTTL),
+	}
+	challenges.mu.Unlock()
+
+	resp := append([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x73, 0x0A}, b[:]...)
+	if _, err := conn.WriteToUDP(resp, remoteAddr); err != nil {
+		slog.Warn("Challenge reply failed", "addr", remoteAddr.String(), "err", err)
+	}
+}
+
+// verifyChallenge 检查心跳携带的 challenge，验证通过后作废
+func verifyChallenge(address string, value uint32) error {
+	challenges.mu.Lock()
+	defer challenges.mu.Unlock()
+
+	entry, ok := challenges.m[address]
+	if !ok {
+		return errors.New("no challenge issued")
+	}
+	if time.Now().After(entry.Expires) {
+		delete(challenges.m, address)
+		return errors.New("challenge expired")
+	}
+	if entry.Value != value {
+		return errors.New("challenge mismatch")
+	}
+	delete(challenges.m, address)
+	return nil
+}
+
+// purgeChallenges 清理过期未使用的 challenge
+func purgeChallenges() {
+	challenges.mu.Lock()
+	defer challenges.mu.Unlock()
+	purgeChallengesLocked(time.Now())
+}
+
+// purgeChallengesLocked 同 purgeChallenges，调用方需持有 challenges.mu
+func purgeChallengesLocked(now time.Time) {
+	for addr, entry := range challenges.m {
+		if now.After(entry.Expires) {
+			delete(challenges.m, addr)
+		}
+	}
+}
+
+// handleHeartbeat 处理心跳: '0' '\n' \protocol\48\challenge\<n>\...
+func handleHeartbeat(remoteAddr *net.UDPAddr, data []byte) {
+	address := remoteAddr.String()
+	info := parseInfoString(string(data[1:]))
+
+	raw, ok := info["challenge"]
+	if !ok {
+		slog.Info("Heartbeat rejected", "addr", address, "reason", "missing challenge")
+		scanners.Invalid(remoteAddr.IP.String())
+		return
+	}
+	// HLDS 以有符号整数打印 challenge
+	value, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		slog.Info("Heartbeat rejected", "addr", address, "reason", "bad challenge", "challenge", raw)
+		scanners.Invalid(remoteAddr.IP.String())
+		return
+	}
+	if err := verifyChallenge(address, uint32(value)); err != nil {
+		slog.Info("Heartbeat rejected", "addr", address, "reason", err.Error())
+		scanners.Invalid(remoteAddr.IP.String())
+		return
+	}
+	// 心跳中的 gamedir 只是服务器自报，最终以 A2S_INFO 为准
+	if gamedir := info["gamedir"]; gamedir != "" && !gameAllowed(gamedir) {
+		slog.Debug("Heartbeat rejected", "addr", address, "reason", "game not allowed", "gamedir", gamedir)
+		return
+	}
+	if registerServer(address, "", heartbeatServerInfo(info)) && upstream != nil {
+		upstream.Relay(address, info)
+	}
+}
+
+// heartbeatServerInfo 从 Quake3 风格的心跳信息串中取出服务器信息
+// (\hostname\..\mapname\..\clients\..)；没有 hostname 时返回 nil，由 A2S_INFO 查询
+func heartbeatServerInfo(info map[string]string) *ServerInfo {
+	name := info["hostname"]
+	if name == "" {
+		return nil
+	}
+	first := func(keys ...string) string {
+		for _, k := range keys {
+			if v := info[k]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+	number := func(keys ...string) int {
+		n, _ := strconv.Atoi(first(keys...))
+		return n
+	}
+	s := &ServerInfo{
+		Name:       name,
+		Map:        first("mapname", "map"),
+		GameDir:    first("gamedir", "fs_game"),
+		GameDesc:   first("gamename", "game"),
+		Players:    number("clients", "players"),
+		MaxPlayers: number("sv_maxclients", "max"),
+		Bots:       number("bots"),
+		Passworded: number("g_needpass", "password") == 1,
+		Secure:     number("secure") == 1,
+		Version:    first("version"),
+		Protocol:   number("protocol"),
+		Keywords:   splitKeywords(first("gametype", "tags")),
+	}
+	// GoldSrc 心跳为 \type\d，Quake3 为 \dedicated\1 或 2
+	switch first("type", "dedicated") {
+	case "d", "1", "2":
+		s.Dedicated = true
+	}
+	if env := info["os"]; len(env) == 1 {
+		s.OS = osName(env[0])
+	}
+	return s
+}
+
+// parseInfoString 解析 \key\value\key\value 格式的字符串
+func parseInfoString(s string) map[string]string {
+	s = strings.TrimSpace(strings.TrimRight(s, "\x00"))
+	s = strings.TrimPrefix(s, "\\")
+
+	info := make(map[string]string)
+	parts := strings.Split(s, "\\")
+	for i := 0; i+1 < len(parts); i += 2 {
+		info[strings.ToLower(parts[i])] = parts[i+1]
+	}
+	return info
+}
+
+// masterQuery 客户端发来的服务器列表请求
+type masterQuery struct {
+	Region byte   // 区域代码，0xFF 表示全部
+	Seed   string // 上一批最后一个地址，"0.0.0.0:0" 表示从头开始
+	Filter string // 过滤字符串，例如 \gamedir\cstrike
+	Legacy bool   // 旧版客户端，期望 'd' 格式的回复
+}
+
+// 单个回复包的最大长度，与 Valve Master 保持一致
+const masterMaxPacket = 1400
+
+// 服务器列表回复头: 0xFF 0xFF 0xFF 0xFF 'f' '\n'
+var masterReplyHeader = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x66, 0x0A}
+
+// 旧版服务器列表回复头: 0xFF 0xFF 0xFF 0xFF 'd' '\n'
+var legacyReplyHeader = []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x64, 0x0A}
+
+// parseMasterQuery 解析客户端请求，支持以下格式:
+//
+//	'1' <region> <seed>\0 <filter>\0  当前格式，回复 'f'，以 0.0.0.0:0 结束
+//	'1' <seed>\0 <filter>\0           早期 Steam 客户端省略区域字节，按 0xFF 处理
+//	'c' [<filter>]                    旧版 HL1 客户端，回复 'd'，不分批也没有结束标记
+//
+// 区域代码只会是 0x00-0x07 或 0xFF，而 seed 总以数字开头，据此判断是否省略了区域字节。
+func parseMasterQuery(payload []byte) (masterQuery, bool) {
+	var q masterQuery
+	if len(payload) > 0 && payload[0] == opLegacyQuery {
+		q.Region = 0xFF
+		q.Legacy = true
+		q.Filter = strings.TrimRight(string(payload[1:]), "\x00\n")
+		return q, true
+	}
+	if len(payload) < 3 || payload[0] != opMasterQuery {
+		return q, false
+	}
+
+	rest := payload[1:]
+	if rest[0] >= '0' && rest[0] <= '9' {
+		q.Region = 0xFF
+	} else {
+		q.Region = rest[0]
+		rest = rest[1:]
+	}
+	end := bytes.IndexByte(rest, 0x00)
+	if end < 0 {
+		return q, false
+	}
+	q.Seed = string(rest[:end])
+	rest = rest[end+1:]
+
+	// 部分客户端不发送过滤字符串的结尾 0x00
+	if end = bytes.IndexByte(rest, 0x00); end >= 0 {
+		rest = rest[:end]
+	}
+	q.Filter = string(rest)
+	return q, true
+}
+
+// masterQueryMinSize '1' 请求的最小长度: 操作码 + 最短的 seed "0.0.0.0:0\x00"
+const masterQueryMinSize = 11
+
+// legacyReplyFactor 未验证来源的旧版列表回复最多为请求长度的几倍
+const legacyReplyFactor = 4
+
+// verifiedClientTTL 客户端通过 challenge 验证后，多久之内的旧版请求不受 legacyReplyFactor 限制
+const verifiedClientTTL = 10 * time.Minute
+
+// verifiedClients 最近带回有效 challenge 的客户端 IP，来源地址已经过验证，不是伪造的
+var verifiedClients = &clientSet{entries: make(map[string]time.Time)}
+
+// clientSet 带过期时间的 IP 集合，在清理循环中删除过期的记录
+type clientSet struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+}
+
+func (c *clientSet) Add(ip string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[ip] = time.Now().Add(verifiedClientTTL)
+}
+
+func (c *clientSet) Has(ip string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Now().Before(c.entries[ip])
+}
+
+// purge 删除过期的记录
+func (c *clientSet) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for ip, expires := range c.entries {
+		if !now.Before(expires) {
+			delete(c.entries, ip)
+		}
+	}
+}
+
+// logDroppedQuery 记录被丢弃的列表请求及来源，同一 IP 每分钟最多一条
+func logDroppedQuery(remoteAddr *net.UDPAddr, reason string) {
+	if droppedQueryLog.Allow(remoteAddr.IP.String()) {
+		slog.Warn("Master query dropped", "addr", remoteAddr.String(), "reason", reason)
+	}
+}
+
+// clientChallengeSecret 计算客户端 challenge 的密钥，进程启动时随机生成
+var clientChallengeSecret = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// clientChallenge 由客户端 IP 和时间窗口计算 challenge，不需要为每个客户端保存状态，
+// 伪造来源地址的请求拿不到发往真实地址的 challenge
+func clientChallenge(ip net.IP, window int64) uint32 {
+	mac := hmac.New(sha256.New, clientChallengeSecret)
+	mac.Write(ip.To16())
+	var w [8]byte
+	binary.LittleEndian.PutUint64(w[:], uint64(window))
+	mac.Write(w[:])
+	return binary.LittleEndian.Uint32(mac.Sum(nil))
+}
+
+// validClientChallenge 检查客户端带回的 challenge (十进制)，当前和上一个窗口的值都有效
+func validClientChallenge(ip net.IP, value string) bool {
+	v, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return false
+	}
+	window := time.Now().Unix() / int64(challengeTTL/time.Second)
+	return uint32(v) == clientChallenge(ip, window) || uint32(v) == clientChallenge(ip, window-1)
+}
+
+// sendClientChallenge 回复与服务器心跳相同格式的 challenge: 0xFFFFFFFF 's' '\n' <challenge>，
+// 回复不比请求大，不会被用来放大流量
+func sendClientChallenge(conn *net.UDPConn, remoteAddr *net.UDPAddr) {
+	window := time.Now().Unix() / int64(challengeTTL/time.Second)
+	resp := binary.LittleEndian.AppendUint32([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x73, 0x0A}, clientChallenge(remoteAddr.IP, window))
+	if _, err := conn.WriteToUDP(resp, remoteAddr); err != nil {
+		slog.Warn("Master reply failed", "addr", remoteAddr.String(), "err", err)
+	}
+}
+
+// handleMasterQuery 回复客户端的服务器列表请求。
+// 默认只返回 IPv4 服务器 (每条 6 字节)；过滤字符串带 \ipv6\1 扩展时，
+// 所有地址按 16 字节 IP + 2 字节端口返回，IPv4 以 ::ffff:a.b.c.d 形式表示。
+// 回复格式由 -master-compat 决定，auto 时 'c' 请求得到旧版格式，'1' 请求得到当前格式。
+func handleMasterQuery(conn *net.UDPConn, remoteAddr *net.UDPAddr, payload []byte) {
+	// 过短的请求不可能来自正常客户端，直接丢弃，连空回复也不给
+	if payload[0] == opMasterQuery && len(payload) < masterQueryMinSize {
+		droppedPackets.Add(1)
+		scanners.Invalid(remoteAddr.IP.String())
+		logDroppedQuery(remoteAddr, "query too short")
+		return
+	}
+	q, ok := parseMasterQuery(payload)
+	if !ok {
+		scanners.Invalid(remoteAddr.IP.String())
+		// 没有回复时部分客户端会不停重试，回一个只有结束标记的空列表让它停下
+		if !malformedQueryLimiter.Allow(remoteAddr.IP.String()) {
+			rateLimitedPackets.Add(1)
+			return
+		}
+		slog.Debug("Malformed master query", "addr", remoteAddr.String(), "len", len(payload))
+		resp := append(append([]byte{}, masterReplyHeader...), make([]byte, 6)...)
+		if _, err := conn.WriteToUDP(resp, remoteAddr); err != nil {
+			slog.Warn("Master reply failed", "addr", remoteAddr.String(), "err", err)
+		}
+		return
+	}
+	// 旧版请求无法携带 challenge，开启 -master-challenge 后不予回复
+	if config.MasterChallenge {
+		if q.Legacy {
+			logDroppedQuery(remoteAddr, "legacy query without challenge")
+			return
+		}
+		if !validClientChallenge(remoteAddr.IP, parseInfoString(q.Filter)["challenge"]) {
+			sendClientChallenge(conn, remoteAddr)
+			return
+		}
+		verifiedClients.Add(remoteAddr.IP.String())
+	}
+	legacy := q.Legacy
+	switch config.MasterCompat {
+	case "modern":
+		legacy = false
+	case "legacy":
+		legacy = true
+	}
+	// 旧版客户端不认识 IPv6 扩展
+	ipv6 := !legacy && parseInfoString(q.Filter)["ipv6"] == "1"
+
+	entrySize := 6
+	if ipv6 {
+		entrySize = 18
+	}
+	maxEntries := (masterMaxPacket - len(masterReplyHeader) - entrySize) / entrySize
+
+	seed, err := netip.ParseAddrPort(q.Seed)
+	seeded := err == nil && seed.Addr().IsValid() && !seed.Addr().IsUnspecified()
+	if seeded {
+		seed = netip.AddrPortFrom(seed.Addr().Unmap(), seed.Port())
+	}
+
+	// 翻页请求沿用该客户端上一页的顺序，否则 random 等顺序下会重复或遗漏服务器
+	var list []netip.AddrPort
+	if seeded && config.ListOrder != "address" {
+		list = masterOrders.load(remoteAddr.String())
+	}
+	if list == nil {
+		// 区域未知的服务器只出现在全部区域的请求中
+		entries := listedServers(ipv6, func(s *ServerInfo) bool {
+			return matchFilter(s, q.Filter) && (q.Region == regionAll || s.Region == int(q.Region))
+		})
+		list = orderMasterList(entries, config.ListOrder)
+		if !legacy && config.ListOrder != "address" && len(list) > maxEntries {
+			masterOrders.store(remoteAddr.String(), list)
+		}
+	}
+
+	if legacy {
+		// 旧版回复不分批，一次请求可能换来多个包，而旧版请求无法携带 challenge。
+		// 来源未通过 challenge 验证时只回复一个包，且不超过请求长度的 legacyReplyFactor 倍
+		maxBytes := 0
+		if !verifiedClients.Has(remoteAddr.IP.String()) {
+			maxBytes = legacyReplyFactor * len(payload)
+		}
+		if !sendLegacyList(conn, remoteAddr, list, maxBytes) {
+			logDroppedQuery(remoteAddr, "unverified legacy query too short")
+		}
+		return
+	}
+
+	start := 0
+	if seeded {
+		if config.ListOrder == "address" {
+			start = sort.Search(len(list), func(i int) bool {
+				return list[i].Compare(seed) > 0
+			})
+		} else {
+			// seed 不在列表中时只回复结束标记，避免客户端从头循环拉取
+			start = len(list)
+			for i, ap := range list {
+				if ap == seed {
+					start = i + 1
+					break
+				}
+			}
+		}
+	}
+
+	resp := make([]byte, 0, masterMaxPacket)
+	resp = append(resp, masterReplyHeader...)
+
+	end := start + maxEntries
+	if end > len(list) {
+		end = len(list)
+	}
+	for _, ap := range list[start:end] {
+		resp = appendAddrPort(resp, ap, ipv6)
+	}
+	// 最后一批以全 0 地址 (0.0.0.0:0) 结束，客户端据此停止请求
+	if end == len(list) {
+		resp = append(resp, make([]byte, entrySize)...)
+	}
+
+	if _, err := conn.WriteToUDP(resp, remoteAddr); err != nil {
+		slog.Warn("Master reply failed", "addr", remoteAddr.String(), "err", err)
+	}
+}
+
+// listedAddrs 返回已验证且满足 include 的服务器地址，按地址排序，保证客户端用 seed 分批拉取时顺序稳定。
+// 未通过 A2S_INFO 验证的服务器可能是伪造的心跳，不对外公布；ipv6 为 false 时只返回 IPv4 地址。
+func listedAddrs(ipv6 bool, include func(*ServerInfo) bool) []netip.AddrPort {
+	return orderMasterList(listedServers(ipv6, include), "address")
+}
+
+// listedServer Master 列表中的一项，附带排序所需的字段
+type listedServer struct {
+	Addr     netip.AddrPort
+	LastSeen time.Time
+	Players  int
+}
+
+// listedServers 与 listedAddrs 的筛选条件相同，返回的顺序不固定
+func listedServers(ipv6 bool, include func(*ServerInfo) bool) []listedServer {
+	var list []listedServer
+	manager.Each(func(s *ServerInfo) {
+		if !s.Listed || belowPlayerThreshold(s) || (include != nil && !include(s)) {
+			return
+		}
+		ap, err := netip.ParseAddrPort(s.Address)
+		if err != nil {
+			return
+		}
+		ap = netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port())
+		if !ipv6 && !ap.Addr().Is4() {
+			return
+		}
+		list = append(list, listedServer{Addr: ap, LastSeen: s.LastSeen, Players: s.Players})
+	})
+	return list
+}
+
+// orderMasterList 按 -list-order 排列 Master 列表并返回地址，
+// 除 random 外相同条件下按地址排序，保证结果稳定
+func orderMasterList(list []listedServer, order string) []netip.AddrPort {
+	sort.Slice(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		switch order {
+		case "lastseen":
+			if !a.LastSeen.Equal(b.LastSeen) {
+				return a.LastSeen.After(b.LastSeen)
+			}
+		case "least-populated-first":
+			if a.Players != b.Players {
+				return a.Players < b.Players
+			}
+		}
+		return a.Addr.Compare(b.Addr) < 0
+	})
+	if order == "random" {
+		mathrand.Shuffle(len(list), func(i, j int) {
+			list[i], list[j] = list[j], list[i]
+		})
+	}
+	addrs := make([]netip.AddrPort, len(list))
+	for i, s := range list {
+		addrs[i] = s.Addr
+	}
+	return addrs
+}
+
+// masterOrderTTL 客户端翻页时沿用上一页顺序的最长时间
+const masterOrderTTL = 30 * time.Second
+
+// masterOrders 记录列表超过一个包的客户端最近一次拿到的顺序，按客户端地址索引
+var masterOrders = masterOrderCache{entries: make(map[string]masterOrder)}
+
+type masterOrder struct {
+	list    []netip.AddrPort
+	created time.Time
+}
+
+// maxMasterOrderAddrs masterOrders 中所有顺序合计保存的地址数上限 (约 16 MB)。
+// 未开启 -master-challenge 时伪造来源的请求也会占用条目，超出时先淘汰最早保存的顺序，
+// 被淘汰的客户端翻页时按新的顺序继续
+const maxMasterOrderAddrs = 1 << 19
+
+type masterOrderCache struct {
+	mu      sync.Mutex
+	entries map[string]masterOrder
+	addrs   int // entries 中的地址总数
+}
+
+// load 返回 client 未过期的顺序，没有时返回 nil
+func (c *masterOrderCache) load(client string) []netip.AddrPort {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	o, ok := c.entries[client]
+	if !ok || time.Since(o.created) > masterOrderTTL {
+		return nil
+	}
+	return o.list
+}
+
+// store 保存 client 的顺序，顺带清理过期的条目；地址总数超出 maxMasterOrderAddrs 时淘汰最早的条目
+func (c *masterOrderCache) store(client string, list []netip.AddrPort) {
+	if len(list) > maxMasterOrderAddrs {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.remove(client)
+	for k, o := range c.entries {
+		if now.Sub(o.created) > masterOrderTTL {
+			c.remove(k)
+		}
+	}
+	for c.addrs+len(list) > maxMasterOrderAddrs {
+		oldest := ""
+		for k, o := range c.entries {
+			if oldest == "" || o.created.Before(c.entries[oldest].created) {
+				oldest = k
+			}
+		}
+		c.remove(oldest)
+	}
+	c.entries[client] = masterOrder{list: list, created: now}
+	c.addrs += len(list)
+}
+
+// remove 删除 client 的条目，调用方需持有 c.mu
+func (c *masterOrderCache) remove(client string) {
+	if o, ok := c.entries[client]; ok {
+		c.addrs -= len(o.list)
+		delete(c.entries, client)
+	}
+}
+
+// sendLegacyList 以旧版格式发送完整列表: 每包 'd' 头加若干 6 字节地址，
+// 超过一个包时连续发送多个包，没有 0.0.0.0:0 结束标记。
+// maxBytes 大于 0 时只发送一个不超过该长度的包，连回复头都放不下时不发送并返回 false。
+func sendLegacyList(conn *net.UDPConn, remoteAddr *net.UDPAddr, list []netip.AddrPort, maxBytes int) bool {
+	maxEntries := (masterMaxPacket - len(legacyReplyHeader)) / 6
+	if maxBytes > 0 {
+		if maxBytes < len(legacyReplyHeader) {
+			return false
+		}
+		n := (min(maxBytes, masterMaxPacket) - len(legacyReplyHeader)) / 6
+		maxEntries = max(n, 1)
+		list = list[:min(n, len(list))]
+	}
+	for start := 0; start == 0 || start < len(list); start += maxEntries {
+		end := start + maxEntries
+		if end > len(list) {
+			end = len(list)
+		}
+		resp := make([]byte, 0, masterMaxPacket)
+		resp = append(resp, legacyReplyHeader...)
+		for _, ap := range list[start:end] {
+			resp = appendAddrPort(resp, ap, false)
+		}
+		if _, err := conn.WriteToUDP(resp, remoteAddr); err != nil {
+			slog.Warn("Master reply failed", "addr", remoteAddr.String(), "err", err)
+			return true
+		}
+	}
+	return true
+}
+
+// filterTerm 过滤字符串中的一个 \key\value 条件
+type filterTerm struct {
+	Key   string
+	Value string
+}
+
+// serverFilter 解析后的过滤字符串
+type serverFilter []filterTerm
+
+// parseFilter 解析 \gamedir\cstrike\map\de_dust2 形式的过滤字符串
+func parseFilter(filter string) serverFilter {
+	parts := strings.Split(strings.TrimPrefix(filter, "\\"), "\\")
+	var terms serverFilter
+	for i := 0; i+1 < len(parts); i += 2 {
+		terms = append(terms, filterTerm{Key: strings.ToLower(parts[i]), Value: parts[i+1]})
+	}
+	return terms
+}
+
+// matchFilter 判断服务器是否满足客户端的过滤条件
+func matchFilter(s *ServerInfo, filter string) bool {
+	return parseFilter(filter).match(s)
+}
+
+// match 所有顶层条件都满足时返回 true
+func (f serverFilter) match(s *ServerInfo) bool {
+	terms := []filterTerm(f)
+	for len(terms) > 0 {
+		var ok bool
+		ok, terms = evalFilterTerm(s, terms)
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// evalFilterTerm 计算第一个条件，返回结果和剩余的条件。
+// \nor\[n]: 后面 n 个条件任意一个满足则排除；\nand\[n]: 后面 n 个条件全部满足则排除。
+// 嵌套的 nor/nand 整体算作一个条件；不认识的条件视为满足。
+func evalFilterTerm(s *ServerInfo, terms []filterTerm) (bool, []filterTerm) {
+	t, rest := terms[0], terms[1:]
+	switch t.Key {
+	case "nor", "nand":
+		n, _ := strconv.Atoi(t.Value)
+		anyOK, allOK := false, true
+		for i := 0; i < n && len(rest) > 0; i++ {
+			var ok bool
+			ok, rest = evalFilterTerm(s, rest)
+			anyOK = anyOK || ok
+			allOK = allOK && ok
+		}
+		if t.Key == "nor" {
+			return !anyOK, rest
+		}
+		return !allOK, rest
+	}
+	return matchFilterTerm(s, t), rest
+}
+
+// matchFilterTerm 判断单个条件
+func matchFilterTerm(s *ServerInfo, t filterTerm) bool {
+	on := t.Value == "1"
+	switch t.Key {
+	case "gamedir":
+		return strings.EqualFold(s.GameDir, t.Value)
+	case "appid":
+		return strconv.Itoa(s.GameID) == t.Value
+	case "napp": // 排除指定 App ID
+		return strconv.Itoa(s.GameID) != t.Value
+	case "map":
+		return strings.EqualFold(s.Map, t.Value)
+	case "dedicated":
+		return !on || s.Dedicated
+	case "secure":
+		return !on || s.Secure
+	case "linux":
+		return !on || s.OS == "Linux"
+	case "password":
+		return t.Value != "0" || !s.Passworded
+	case "empty": // 不显示空服务器
+		return !on || s.Players > 0
+	case "full": // 不显示满员服务器
+		return !on || s.Players < s.MaxPlayers
+	case "noplayers": // 只显示空服务器
+		return !on || s.Players == 0
+	case "gametype": // 必须包含所有指定的关键字
+		for _, tag := range splitKeywords(t.Value) {
+			if !hasKeyword(s.Keywords, tag) {
+				return false
+			}
+		}
+		return true
+	case "name_match":
+		return wildcardMatch(t.Value, s.Name)
+	case "version_match":
+		return wildcardMatch(t.Value, s.Version)
+	case "gameaddr":
+		if strings.Contains(t.Value, ":") {
+			return s.Address == t.Value
+		}
+		ap, err := netip.ParseAddrPort(s.Address)
+		return err == nil && ap.Addr().Unmap().String() == t.Value
+	}
+	return true
+}
+
+// hasKeyword 不区分大小写地查找关键字
+func hasKeyword(keywords []string, tag string) bool {
+	for _, k := range keywords {
+		if strings.EqualFold(k, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// wildcardMatch 支持 * 通配符的不区分大小写匹配
+func wildcardMatch(pattern, s string) bool {
+	pattern, s = strings.ToLower(pattern), strings.ToLower(s)
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == s
+	}
+	if !strings.HasPrefix(s, parts[0]) {
+		return false
+	}
+	s = s[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(s, part)
+		if i < 0 {
+			return false
+		}
+		s = s[i+len(part):]
+	}
+	return strings.HasSuffix(s, parts[len(parts)-1])
+}
+
+// appendAddrPort 追加打包后的地址: 4 字节 IP (ipv6 时为 16 字节) + 2 字节大端端口
+func appendAddrPort(b []byte, ap netip.AddrPort, ipv6 bool) []byte {
+	if ipv6 {
+		ip := ap.Addr().As16()
+		b = append(b, ip[:]...)
+	} else {
+		ip := ap.Addr().As4()
+		b = append(b, ip[:]...)
+	}
+	return binary.BigEndian.AppendUint16(b, ap.Port())
+}
+
+// addressFamily 返回地址所属的协议族: "ipv4" 或 "ipv6"
+func addressFamily(address string) string {
+	ap, err := netip.ParseAddrPort(address)
+	if err == nil && !ap.Addr().Unmap().Is4() {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// upstream 转发心跳并拉取列表的上游 Master，未设置 -upstream-master 时为 nil
+var upstream *upstreamMaster
+
+// upstreamRelayQueue 待转发心跳的缓冲长度，队列满时丢弃
+const upstreamRelayQueue = 256
+
+// upstreamTimeout 等待上游 challenge 或列表回复的时间
+const upstreamTimeout = 5 * time.Second
+
+// upstreamMaxPages 单次拉取最多请求的列表分页数
+const upstreamMaxPages = 100
+
+// upstreamHeartbeat 一次待转发的心跳
+type upstreamHeartbeat struct {
+	Address string
+	Info    map[string]string
+}
+
+// upstreamMaster 上游 Master: 把验证通过的心跳转发过去，并定期合并上游的服务器列表。
+// 从上游得知的服务器 (Source 为 sourceUpstream) 不会被转发，避免两边互相转发形成环路。
+type upstreamMaster struct {
+	addr  *net.UDPAddr
+	queue chan upstreamHeartbeat
+}
+
+func newUpstreamMaster(addr *net.UDPAddr) *upstreamMaster {
+	return &upstreamMaster{
+		addr:  addr,
+		queue: make(chan upstreamHeartbeat, upstreamRelayQueue),
+	}
+}
+
+// Relay 排队转发一次心跳，不阻塞 UDP 读取循环
+func (u *upstreamMaster) Relay(address string, info map[string]string) {
+	select {
+	case u.queue <- upstreamHeartbeat{Address: address, Info: info}:
+	default:
+		slog.Debug("Upstream relay queue full, dropping heartbeat", "addr", address)
+	}
+}
+
+// runRelay 逐个转发排队的心跳，直到 ctx 取消
+func (u *upstreamMaster) runRelay(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case hb := <-u.queue:
+			if err := u.relay(hb); err != nil {
+				slog.Debug("Upstream relay failed", "addr", hb.Address, "upstream", u.addr.String(), "err", err)
+			}
+		}
+	}
+}
+
+// relay 按标准协议向上游发送心跳: 先用 'q' 取 challenge，再发送 '0' '\n' 和信息串。
+// 信息串中附加 \gameaddr\<ip:port> 指明真实服务器；标准的 Master 按来源地址登记服务器，
+// 只有识别该字段的上游才会登记到正确的地址。
+func (u *upstreamMaster) relay(hb upstreamHeartbeat) error {
+	conn, err := net.DialUDP("udp", nil, u.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(upstreamTimeout))
+
+	if _, err := conn.Write([]byte("q")); err != nil {
+		return err
+	}
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return err
+	}
+	if n < 10 || !bytes.HasPrefix(buf[:n], []byte{0xFF, 0xFF, 0xFF, 0xFF, 0x73, 0x0A}) {
+		return errors.New("unexpected challenge reply")
+	}
+	challenge := int32(binary.LittleEndian.Uint32(buf[6:10]))
+
+	keys := make([]string, 0, len(hb.Info))
+	for k := range hb.Info {
+		if k != "challenge" && k != "gameaddr" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString("0\n")
+	fmt.Fprintf(&b, "\\challenge\\%d", challenge)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\\%s\\%s", k, hb.Info[k])
+	}
+	fmt.Fprintf(&b, "\\gameaddr\\%s\n", hb.Address)
+	_, err = conn.Write([]byte(b.String()))
+	return err
+}
+
+// runPoll 每隔 interval 拉取一次上游的服务器列表，interval 为 0 时不拉取
+func (u *upstreamMaster) runPoll(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		addrs, err := u.fetchList()
+		if err != nil {
+			slog.Warn("Upstream list fetch failed", "upstream", u.addr.String(), "err", err)
+		}
+		added := 0
+		for _, addr := range addrs {
+			if registerServer(addr, sourceUpstream, nil) {
+				added++
+			}
+		}
+		if len(addrs) > 0 {
+			slog.Debug("Upstream list merged", "upstream", u.addr.String(), "servers", len(addrs), "accepted", added)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetchList 用 '1' 查询逐页拉取上游的完整列表，以上一页最后一个地址作为下一页的 seed，
+// 直到收到 0.0.0.0:0 结束标记
+func (u *upstreamMaster) fetchList() ([]string, error) {
+	conn, err := net.DialUDP("udp", nil, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var addrs []string
+	seed := "0.0.0.0:0"
+	buf := make([]byte, 65535)
+	for page := 0; page < upstreamMaxPages; page++ {
+		conn.SetDeadline(time.Now().Add(upstreamTimeout))
+		query := append([]byte{'1', 0xFF}, seed...)
+		query = append(query, 0, 0)
+		if _, err := conn.Write(query); err != nil {
+			return addrs, err
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			return addrs, err
+		}
+		if n < len(masterReplyHeader) || !bytes.Equal(buf[:len(masterReplyHeader)], masterReplyHeader) {
+			return addrs, errors.New("unexpected list reply")
+		}
+		last := ""
+		for entry := buf[len(masterReplyHeader):n]; len(entry) >= 6; entry = entry[6:] {
+			ap := netip.AddrPortFrom(netip.AddrFrom4([4]byte(entry[:4])), binary.BigEndian.Uint16(entry[4:6]))
+			if !ap.Addr().IsUnspecified() || ap.Port() != 0 {
+				last = ap.String()
+				addrs = append(addrs, last)
+				continue
+			}
+			return addrs, nil
+		}
+		if last == "" {
+			return addrs, errors.New("empty list page without terminator")
+		}
+		seed = last
+	}
+	return addrs, fmt.Errorf("list longer than %d pages", upstreamMaxPages)
+}
+
+// 服务器列表变化事件类型
+const (
+	eventAdded   = "server_added"
+	eventRemoved = "server_removed"
+	eventUpdated = "server_updated"
+)
+
+// Event 服务器列表的一次变化
+type Event struct {
+	Type    string    `json:"event"`
+	Address string    `json:"address"`
+	Name    string    `json:"name"`
+	Time    time.Time `json:"time"`
+}
+
+// eventLogSize /api/events 保留的上线/下线事件数量
+const eventLogSize = 1000
+
+// eventHub 把服务器列表的变化分发给所有订阅者，并保留最近的上线/下线事件
+type eventHub struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	recent []Event // 按时间从旧到新，最多 eventLogSize 条
+
+	version atomic.Uint64 // 每发布一个事件加一，渲染缓存据此判断列表是否变化
+}
+
+var events = &eventHub{
+	subs: make(map[chan Event]struct{}),
+}
+
+// Subscribe 订阅变化事件，size 为缓冲长度
+func (h *eventHub) Subscribe(size int) chan Event {
+	ch := make(chan Event, size)
+	h.mu.Lock()
+	h.subs[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe 取消订阅
+func (h *eventHub) Unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	delete(h.subs, ch)
+	h.mu.Unlock()
+}
+
+// Publish 非阻塞地发送事件，订阅者缓冲已满时丢弃，不拖慢 UDP 和查询流程
+func (h *eventHub) Publish(typ, address, name string) {
+	e := Event{Type: typ, Address: address, Name: name, Time: time.Now()}
+	h.version.Add(1)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if typ == eventAdded || typ == eventRemoved {
+		h.recent = append(h.recent, e)
+		if len(h.recent) > eventLogSize {
+			h.recent = h.recent[len(h.recent)-eventLogSize:]
+		}
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Version 返回当前的事件序号，两次取值相同说明期间列表没有变化
+func (h *eventHub) Version() uint64 {
+	return h.version.Load()
+}
+
+// Since 返回 since 之后的上线/下线事件副本，按时间从旧到新
+func (h *eventHub) Since(since time.Time) []Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	i := sort.Search(len(h.recent), func(i int) bool {
+		return h.recent[i].Time.After(since)
+	})
+	return append([]Event{}, h.recent[i:]...)
+}
+
+// webhookQueueSize 等待发送的 webhook 事件上限，超出时丢弃新事件
+const webhookQueueSize = 256
+
+// webhookTimeout 单次 webhook 请求的超时时间
+const webhookTimeout = 5 * time.Second
+
+// runWebhook 逐个把服务器上线/下线事件 POST 到 endpoint，只在这个 goroutine 中发起网络请求，
+// 对方响应慢时事件在 ch 中排队，不会阻塞 UDP 和清理流程
+func runWebhook(ctx context.Context, endpoint string, ch chan Event) {
+	defer events.Unsubscribe(ch)
+	client := &http.Client{Timeout: webhookTimeout}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case e := <-ch:
+			if e.Type != eventAdded && e.Type != eventRemoved {
+				continue
+			}
+			if err := postWebhook(ctx, client, endpoint, e); err != nil {
+				slog.Warn("Webhook failed", "event", e.Type, "addr", e.Address, "err", err)
+			}
+		}
+	}
+}
+
+// postWebhook 发送单个事件，非 2xx 响应视为失败
+func postWebhook(ctx context.Context, client *http.Client, endpoint string, e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// geoDB 只读的 MaxMind DB (GeoLite2-Country / GeoLite2-City) 解析器
+type geoDB struct {
+	data       []byte
+	nodeCount  uint
+	recordSize uint
+	ipv4Start  uint // IPv6 树中 ::a.b.c.d 子树的起点
+	dataStart  int  // 数据段起始位置
+}
+
+// geoRecord 查询到的国家信息
+type geoRecord struct {
+	CountryCode  string
+	Country      string
+	Continent    string
+	Longitude    float64 // 只有 City 数据库才有
+	HasLongitude bool
+}
+
+// geoip 未配置数据库时为 nil，跳过解析
+var geoip *geoDB
+
+// mmdb 元数据起始标记
+var mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+
+// openGeoDB 读取整个数据库文件并解析元数据
+func openGeoDB(path string) (*geoDB, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	idx := bytes.LastIndex(data, mmdbMetadataMarker)
+	if idx < 0 {
+		return nil, errors.New("not a MaxMind DB file")
+	}
+	db := &geoDB{data: data}
+	meta, _, err := db.decode(idx+len(mmdbMetadataMarker), idx+len(mmdbMetadataMarker))
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	m, _ := meta.(map[string]any)
+	db.nodeCount = uint(asUint(m["node_count"]))
+	db.recordSize = uint(asUint(m["record_size"]))
+	if db.recordSize != 24 && db.recordSize != 28 && db.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", db.recordSize)
+	}
+	treeSize := int(db.nodeCount * db.recordSize / 4)
+	db.dataStart = treeSize + 16
+	if db.dataStart > idx {
+		return nil, errors.New("corrupt search tree")
+	}
+
+	// IPv6 数据库中 IPv4 地址位于前 96 位为 0 的子树
+	if asUint(m["ip_version"]) == 6 {
+		node := uint(0)
+		for i := 0; i < 96 && node < db.nodeCount; i++ {
+			node = db.record(node, 0)
+		}
+		db.ipv4Start = node
+	}
+	return db, nil
+}
+
+// record 读取节点的左 (bit=0) 或右 (bit=1) 记录
+func (db *geoDB) record(node uint, bit uint) uint {
+	b := db.data[node*db.recordSize/4:]
+	switch db.recordSize {
+	case 24:
+		off := bit * 3
+		return uint(b[off])<<16 | uint(b[off+1])<<8 | uint(b[off+2])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(b[bit*4:]))
+	}
+}
+
+// Lookup 查询 IP 所属国家，未找到时返回 false
+func (db *geoDB) Lookup(ip netip.Addr) (geoRecord, bool) {
+	var rec geoRecord
+	ip = ip.Unmap()
+	node := uint(0)
+	var bits []byte
+	if ip.Is4() {
+		a := ip.As4()
+		bits, node = a[:], db.ipv4Start
+	} else {
+		a := ip.As16()
+		bits = a[:]
+	}
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	if node <= db.nodeCount {
+		return rec, false
+	}
+
+	offset := db.dataStart + int(node-db.nodeCount) - 16
+	if offset >= len(db.data) {
+		return rec, false
+	}
+	value, _, err := db.decode(offset, db.dataStart)
+	if err != nil {
+		return rec, false
+	}
+	m, _ := value.(map[string]any)
+	country, _ := m["country"].(map[string]any)
+	if country == nil {
+		country, _ = m["registered_country"].(map[string]any)
+	}
+	names, _ := country["names"].(map[string]any)
+	continent, _ := m["continent"].(map[string]any)
+	rec.CountryCode, _ = country["iso_code"].(string)
+	rec.Country, _ = names["en"].(string)
+	rec.Continent, _ = continent["code"].(string)
+	location, _ := m["location"].(map[string]any)
+	rec.Longitude, rec.HasLongitude = location["longitude"].(float64)
+	return rec, rec.CountryCode != ""
+}
+
+// mmdbMaxDepth 解析时 map、array 和指针的最大嵌套层数。实际数据库不超过几层，
+// 超出说明数据损坏，例如指针指回包含它的 map，继续解析会无限递归
+const mmdbMaxDepth = 32
+
+// decode 解析 offset 处的一个数据字段，base 为指针的基准位置，返回下一个字段的位置
+func (db *geoDB) decode(offset, base int) (any, int, error) {
+	return db.decodeDepth(offset, base, 0)
+}
+
+// decodeDepth 同 decode，depth 为当前嵌套层数
+func (db *geoDB) decodeDepth(offset, base, depth int) (any, int, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	if offset >= len(db.data) {
+		return nil, 0, errors.New("offset out of range")
+	}
+	ctrl := db.data[offset]
+	offset++
+	typ := int(ctrl >> 5)
+
+	// 指针: 跳转到数据段的其他位置读取，读取完后从指针之后继续
+	if typ == 1 {
+		ss, vvv := int(ctrl>>3)&3, int(ctrl&7)
+		if offset+ss+1 > len(db.data) {
+			return nil, 0, errors.New("pointer out of range")
+		}
+		b := db.data[offset : offset+ss+1]
+		var p int
+		switch ss {
+		case 0:
+			p = vvv<<8 | int(b[0])
+		case 1:
+			p = (vvv<<16 | int(b[0])<<8 | int(b[1])) + 2048
+		case 2:
+			p = (vvv<<24 | int(b[0])<<16 | int(b[1])<<8 | int(b[2])) + 526336
+		default:
+			p = int(binary.BigEndian.Uint32(b))
+		}
+		value, _, err := db.decodeDepth(base+p, base, depth+1)
+		return value, offset + ss + 1, err
+	}
+
+	if typ == 0 { // 扩展类型
+		if offset >= len(db.data) {
+			return nil, 0, errors.New("extended type out of range")
+		}
+		typ = 7 + int(db.data[offset])
+		offset++
+	}
+
+	size := int(ctrl & 0x1F)
+	if size >= 29 {
+		n := size - 28
+		if offset+n > len(db.data) {
+			return nil, 0, errors.New("size out of range")
+		}
+		v := 0
+		for _, c := range db.data[offset : offset+n] {
+			v = v<<8 | int(c)
+		}
+		size = []int{0, 29, 285, 65821}[n] + v
+		offset += n
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, size)
+		for i := 0; i < size; i++ {
+			k, next, err := db.decodeDepth(offset, base, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			v, next, err := db.decodeDepth(next, base, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, _ := k.(string)
+			m[key] = v
+			offset = next
+		}
+		return m, offset, nil
+	case 11: // array
+		a := make([]any, 0, size)
+		for i := 0; i < size; i++ {
+			v, next, err := db.decodeDepth(offset, base, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, v)
+			offset = next
+		}
+		return a, offset, nil
+	case 14: // boolean，值保存在 size 中
+		return size != 0, offset, nil
+	}
+
+	if offset+size > len(db.data) {
+		return nil, 0, errors.New("value out of range")
+	}
+	b := db.data[offset : offset+size]
+	offset += size
+	switch typ {
+	case 2: // utf8 string
+		return string(b), offset, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errors.New("bad double size")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), offset, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errors.New("bad float size")
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset, nil
+	case 5, 6, 8, 9, 10: // uint16, uint32, int32, uint64, uint128 (只保留低 64 位)
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		if typ == 8 {
+			return int64(int32(v)), offset, nil
+		}
+		return v, offset, nil
+	}
+	// bytes、数据缓存容器等类型不需要解析内容
+	return nil, offset, nil
+}
+
+// asUint 把解析出的整数统一转换为 uint64
+func asUint(v any) uint64 {
+	switch n := v.(type) {
+	case uint64:
+		return n
+	case int64:
+		return uint64(n)
+	}
+	return 0
+}
+
+// resolveCountry 为服务器填充国家信息，未配置数据库时什么都不做
+// 同时更新 Valve 区域代码，查不到时区域为未知
+func resolveCountry(s *ServerInfo) {
+	s.Region = regionUnknown
+	if geoip == nil {
+		return
+	}
+	ap, err := netip.ParseAddrPort(s.Address)
+	if err != nil {
+		return
+	}
+	if rec, ok := geoip.Lookup(ap.Addr()); ok {
+		s.CountryCode = rec.CountryCode
+		s.Country = rec.Country
+		s.Region = valveRegion(rec)
+	}
+}
+
+// Valve Master 查询中的区域代码，0xFF 表示全部区域
+const (
+	regionUSEast       = 0x00
+	regionUSWest       = 0x01
+	regionSouthAmerica = 0x02
+	regionEurope       = 0x03
+	regionAsia         = 0x04
+	regionAustralia    = 0x05
+	regionMiddleEast   = 0x06
+	regionAfrica       = 0x07
+	regionAll          = 0xFF
+	regionUnknown      = -1
+)
+
+// regionNames 区域代码的显示名称
+var regionNames = map[int]string{
+	regionUSEast:       "美国东部",
+	regionUSWest:       "美国西部",
+	regionSouthAmerica: "南美",
+	regionEurope:       "欧洲",
+	regionAsia:         "亚洲",
+	regionAustralia:    "澳洲",
+	regionMiddleEast:   "中东",
+	regionAfrica:       "非洲",
+}
+
+// middleEast 归入中东区域的亚洲国家
+var middleEast = map[string]bool{
+	"AE": true, "BH": true, "IL": true, "IQ": true, "IR": true, "JO": true, "KW": true,
+	"LB": true, "OM": true, "PS": true, "QA": true, "SA": true, "SY": true, "YE": true,
+}
+
+// valveRegion 按大洲映射 Valve 区域。北美以西经 100 度为界分东西部，
+// 没有经度 (Country 数据库) 时归入东部
+func valveRegion(rec geoRecord) int {
+	switch rec.Continent {
+	case "NA":
+		if rec.HasLongitude && rec.Longitude < -100 {
+			return regionUSWest
+		}
+		return regionUSEast
+	case "SA":
+		return regionSouthAmerica
+	case "EU":
+		return regionEurope
+	case "AS":
+		if middleEast[rec.CountryCode] {
+			return regionMiddleEast
+		}
+		return regionAsia
+	case "OC":
+		return regionAustralia
+	case "AF":
+		return regionAfrica
+	}
+	return regionUnknown
+}
+
+// RegionName 返回区域的显示名称，供模板使用
+func (s ServerInfo) RegionName() string {
+	return regionNames[s.Region]
+}
+
+// countryFlag 把两位国家代码转换为旗帜 emoji
+func countryFlag(code string) string {
+	if len(code) != 2 {
+		return ""
+	}
+	code = strings.ToUpper(code)
+	var b strings.Builder
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return ""
+		}
+		b.WriteRune(0x1F1E6 + c - 'A')
+	}
+	return b.String()
+}
+
+// banEntry 被封禁 IP 的记录
+type banEntry struct {
+	Time   time.Time `json:"time"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// banlist 按 IP 保存被封禁的服务器，来自这些 IP 的心跳会被忽略
+var banlist = struct {
+	m  map[string]banEntry
+	mu sync.RWMutex
+}{
+	m: make(map[string]banEntry),
+}
+
+// bannedIP 封禁列表的一项，用于 /admin/bans 和 -ban-file
+type bannedIP struct {
+	IP string `json:"ip"`
+	banEntry
+}
+
+// bannedIPs 按 IP 排序返回封禁列表的副本
+func bannedIPs() []bannedIP {
+	banlist.mu.RLock()
+	list := make([]bannedIP, 0, len(banlist.m))
+	for ip, e := range banlist.m {
+		list = append(list, bannedIP{IP: ip, banEntry: e})
+	}
+	banlist.mu.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// persistBans 设置了 -ban-file 时写入当前的封禁列表，失败只记录日志
+func persistBans() {
+	if config.BanFile == "" {
+		return
+	}
+	if err := saveBans(config.BanFile); err != nil {
+		slog.Error("Saving banlist failed", "path", config.BanFile, "err", err)
+	}
+}
+
+// saveBans 先写临时文件再重命名，避免写到一半时崩溃留下损坏的文件
+func saveBans(path string) error {
+	data, err := json.MarshalIndent(bannedIPs(), "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// loadBans 从文件恢复封禁列表，文件不存在或损坏时记录警告并以空列表启动
+func loadBans(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			slog.Warn("Banlist not loaded", "path", path, "err", err)
+		}
+		return
+	}
+	var list []bannedIP
+	if err := json.Unmarshal(data, &list); err != nil {
+		slog.Warn("Banlist file is corrupt, starting empty", "path", path, "err", err)
+		return
+	}
+	banlist.mu.Lock()
+	for _, b := range list {
+		if _, err := netip.ParseAddr(b.IP); err == nil {
+			banlist.m[b.IP] = b.banEntry
+		}
+	}
+	banlist.mu.Unlock()
+	slog.Info("Banlist loaded", "path", path, "bans", len(list))
+}
+
+// addressIP 返回 ip:port 地址中的 IP 部分，无法解析时原样返回
+func addressIP(address string) string {
+	if ap, err := netip.ParseAddrPort(address); err == nil {
+		return ap.Addr().Unmap().String()
+	}
+	return address
+}
+
+// isBanned 检查地址所属的 IP 是否在封禁列表中
+func isBanned(address string) bool {
+	banlist.mu.RLock()
+	defer banlist.mu.RUnlock()
+	_, ok := banlist.m[addressIP(address)]
+	return ok
+}
+
+// allowedGames -allowed-games 解析后的游戏目录集合，为空表示不限制
+var allowedGames map[string]bool
+
+// parseGameList 解析逗号分隔的游戏目录列表，统一转为小写
+func parseGameList(s string) map[string]bool {
+	games := make(map[string]bool)
+	for _, g := range strings.Split(s, ",") {
+		if g = strings.ToLower(strings.TrimSpace(g)); g != "" {
+			games[g] = true
+		}
+	}
+	return games
+}
+
+// gameAllowed 检查游戏目录是否在允许列表中
+func gameAllowed(gamedir string) bool {
+	return len(allowedGames) == 0 || allowedGames[strings.ToLower(gamedir)]
+}
+
+// 反向解析的缓存时间 (成功和失败都缓存)、单次超时、并发数和排队上限
+const (
+	rdnsCacheTTL  = time.Hour
+	rdnsTimeout   = 2 * time.Second
+	rdnsWorkers   = 4
+	rdnsQueueSize = 1024
+)
+
+// rdns 反向解析器，为 nil 时不解析
+var rdns *reverseDNS
+
+// rdnsEntry 缓存的解析结果，Name 为空表示没有 PTR 记录或解析失败
+type rdnsEntry struct {
+	Name    string
+	Expires time.Time
+}
+
+// reverseDNS 在后台 worker 中按 IP 反向解析，结果缓存并写回所有同 IP 的服务器
+type reverseDNS struct {
+	mu      sync.Mutex
+	cache   map[string]rdnsEntry
+	pending map[string]bool
+	queue   chan string
+}
+
+func newReverseDNS() *reverseDNS {
+	return &reverseDNS{
+		cache:   make(map[string]rdnsEntry),
+		pending: make(map[string]bool),
+		queue:   make(chan string, rdnsQueueSize),
+	}
+}
+
+// Request 返回已缓存的主机名；没有缓存时排队解析，队列已满则放弃，从不阻塞调用方
+func (d *reverseDNS) Request(ip string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if e, ok := d.cache[ip]; ok && time.Now().Before(e.Expires) {
+		return e.Name
+	}
+	if d.pending[ip] {
+		return ""
+	}
+	select {
+	case d.queue <- ip:
+		d.pending[ip] = true
+	default:
+	}
+	return ""
+}
+
+// run 启动 workers 个解析 goroutine，ctx 取消后返回
+func (d *reverseDNS) run(ctx context.Context, workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case ip := <-d.queue:
+					d.resolve(ctx, ip)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// resolve 解析单个 IP，并更新所有该 IP 的服务器
+func (d *reverseDNS) resolve(ctx context.Context, ip string) {
+	lookupCtx, cancel := context.WithTimeout(ctx, rdnsTimeout)
+	defer cancel()
+	var name string
+	names, err := net.DefaultResolver.LookupAddr(lookupCtx, ip)
+	if err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	} else {
+		slog.Debug("Reverse DNS lookup failed", "ip", ip, "err", err)
+	}
+
+	d.mu.Lock()
+	d.cache[ip] = rdnsEntry{Name: name, Expires: time.Now().Add(rdnsCacheTTL)}
+	delete(d.pending, ip)
+	d.mu.Unlock()
+
+	if name == "" {
+		return
+	}
+	manager.UpdateAll(func(s *ServerInfo) {
+		if addressIP(s.Address) == ip {
+			s.Hostname = name
+		}
+	})
+}
+
+// purge 清理过期的缓存
+func (d *reverseDNS) purge() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for ip, e := range d.cache {
+		if now.After(e.Expires) {
+			delete(d.cache, ip)
+		}
+	}
+}
+
+// pinnedServers -pinned 指定的置顶服务器，地址统一为 netip.AddrPort 的格式
+var pinnedServers map[string]bool
+
+// parsePinned 解析逗号分隔的地址列表，无效的地址记录警告后忽略
+func parsePinned(s string) map[string]bool {
+	pinned := make(map[string]bool)
+	for _, addr := range strings.Split(s, ",") {
+		if addr = strings.TrimSpace(addr); addr == "" {
+			continue
+		}
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			slog.Warn("Ignoring invalid pinned address", "addr", addr, "err", err)
+			continue
+		}
+		pinned[netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String()] = true
+	}
+	return pinned
+}
+
+// serverTags -tags 文件中每个地址的标签
+var serverTags map[string][]string
+
+// loadTags 读取标签文件: 每行 "ip:port 标签1,标签2"，空行和 # 开头的行忽略。
+// 地址无效的行记录警告后跳过，同一地址出现多次时以最后一行为准。
+func loadTags(path string) (map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string][]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		addr, list := line, ""
+		if sep := strings.IndexAny(line, " \t"); sep >= 0 {
+			addr, list = line[:sep], line[sep+1:]
+		}
+		ap, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			slog.Warn("Ignoring invalid tags line", "path", path, "line", i+1, "err", err)
+			continue
+		}
+		tags[netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String()] = splitKeywords(list)
+	}
+	return tags, nil
+}
+
+// pinFirst 把置顶服务器移到列表最前，二者各自保持原有顺序；
+// 不在列表中的置顶服务器以离线占位条目补上，方便管理员发现故障
+func pinFirst(list []*ServerInfo) []*ServerInfo {
+	if len(pinnedServers) == 0 {
+		return list
+	}
+	seen := make(map[string]bool, len(pinnedServers))
+	var pinned, rest []*ServerInfo
+	for _, s := range list {
+		if s.Pinned {
+			pinned = append(pinned, s)
+			seen[s.Address] = true
+		} else {
+			rest = append(rest, s)
+		}
+	}
+	var missing []string
+	for addr := range pinnedServers {
+		if !seen[addr] {
+			missing = append(missing, addr)
+		}
+	}
+	sort.Strings(missing)
+	for _, addr := range missing {
+		pinned = append(pinned, &ServerInfo{
+			Address: addr,
+			Family:  addressFamily(addr),
+			Name:    addr,
+			Region:  regionUnknown,
+			Pinned:  true,
+			Offline: true,
+		})
+	}
+	return append(pinned, rest...)
+}
+
+// rejectedServers 统计因列表已满而被拒绝的新服务器
+var rejectedServers atomic.Uint64
+
+// capacityWarningLog 列表已满时的警告最多每分钟记录一次，避免伪造心跳刷屏
+var capacityWarningLog = newRateLimiter(time.Minute, 1)
+
+// 服务器的来源，ServerInfo.Source 为空表示服务器直接向本机发送心跳
+const sourceUpstream = "upstream" // 从 -upstream-master 的列表中得知
+
+// registerServer 注册或更新服务器，source 为空表示收到了心跳，sourceUpstream 表示来自上游列表。
+// inline 不为 nil 时是心跳中自带的服务器信息，直接写入并视为已验证，之后不再发送 A2S_INFO；
+// 心跳不带信息时恢复 A2S 查询。地址被拒绝 (封禁、私有地址、列表已满) 时返回 false。
+func registerServer(address, source string, inline *ServerInfo) bool {
+	ignored := "Heartbeat ignored"
+	if source == sourceUpstream {
+		ignored = "Upstream server ignored"
+	}
+	if isBanned(address) {
+		slog.Debug(ignored, "addr", address, "reason", "banned")
+		return false
+	}
+	if !config.AllowPrivate && isPrivateAddress(address) {
+		slog.Debug(ignored, "addr", address, "reason", "private address")
+		return false
+	}
+
+	refresh := func(s *ServerInfo) {
+		now := time.Now()
+		if source == sourceUpstream {
+			// 同时直接发送心跳的服务器以心跳为准
+			if s.Source == sourceUpstream {
+				s.LastSeen = now
+			}
+			return
+		}
+		s.Source = ""
+		s.HeartbeatCount++
+		s.LastHeartbeatInterval = now.Sub(s.LastSeen)
+		s.LastSeen = now
+		s.InlineInfo = inline != nil
+		if inline != nil {
+			s.applyInfo(inline, now)
+			s.Listed = true
+			s.Stale = false
+			s.FailCount = 0
+			s.LastError = ""
+			events.Publish(eventUpdated, address, s.Name)
+		}
+	}
+	if manager.Update(address, refresh) {
+		return true
+	}
+
+	now := time.Now()
+	s := &ServerInfo{
+		Address:   address,
+		Family:    addressFamily(address),
+		Source:    source,
+		FirstSeen: now,
+		LastSeen:  now,
+		Name:      "Scanning...",
+		Pinned:    pinnedServers[address],
+		Tags:      serverTags[address],
+	}
+	if source == "" {
+		s.HeartbeatCount = 1
+	}
+	if inline != nil {
+		s.applyInfo(inline, now)
+		s.InlineInfo = true
+		s.Listed = true
+	}
+	resolveCountry(s)
+	if rdns != nil {
+		s.Hostname = rdns.Request(addressIP(address))
+	}
+
+	added, err := manager.Add(s, config.MaxServers)
+	if err != nil {
+		rejectedServers.Add(1)
+		if capacityWarningLog.Allow("") {
+			slog.Warn("Server list full, rejecting new servers", "max", config.MaxServers, "rejected", rejectedServers.Load())
+		}
+		return false
+	}
+	if !added {
+		// 另一个心跳刚刚注册了同一地址
+		manager.Update(address, refresh)
+		return true
+	}
+	if source == sourceUpstream {
+		slog.Debug("New server detected", "addr", address, "source", source)
+	} else {
+		slog.Info("New server detected", "addr", address)
+	}
+	events.Publish(eventAdded, address, s.Name)
+	return true
+}
+
+// isPrivateAddress 报告地址是否为公网玩家无法访问的私有 (RFC 1918 / fc00::/7)、
+// 回环、链路本地或未指定地址
+func isPrivateAddress(address string) bool {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return false
+	}
+	ip := ap.Addr().Unmap()
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified()
+}
+
+// deregisterServer 服务器正常关闭时立即移除，不必等待超时
+func deregisterServer(address string) {
+	if s, ok := manager.Remove(address); ok {
+		slog.Info("Server shut down", "addr", address)
+		events.Publish(eventRemoved, address, s.Name)
+	}
+}
+
+// templateFuncs 所有页面模板都可使用的品牌设置，外部模板 (-template) 同样可用:
+// {{ siteTitle }} 站点名称 (-site-title)，{{ logoURL }} 标志图片地址 (-logo-url)，未设置时为空字符串
+var templateFuncs = template.FuncMap{
+	"siteTitle": func() string { return config.SiteTitle },
+	"logoURL":   func() string { return config.LogoURL },
+}
+
+// 页面模板在启动时解析一次，模板有误时程序直接退出
+var (
+	listTmpl   = template.Must(template.New("list").Funcs(templateFuncs).Parse(htmlTemplate))
+	detailTmpl = template.Must(template.New("detail").Funcs(templateFuncs).Parse(detailTemplate))
+	byMapTmpl  = template.Must(template.New("bymap").Funcs(templateFuncs).Parse(byMapTemplate))
+)
+
+// handleWeb 处理网页请求，
+// 只在复制快照时持有读锁，渲染和写回客户端时不再阻塞心跳处理
+func handleWeb(w http.ResponseWriter, r *http.Request) {
+	list := visibleServers(snapshotServers(), r)
+	total := len(list)
+	stats := computeStats(list)
+	query := r.URL.Query()
+	key, desc := sortParams(query)
+	list = pinFirst(selectServers(list, query))
+	count := len(list)
+	list, page, paged := paginate(list, query)
+
+	data := struct {
+		Count     int
+		Total     int
+		Stats     serverStats
+		Query     url.Values
+		Sort      string
+		Desc      bool
+		SortLinks map[string]string
+		Paged     bool
+		Page      pageInfo
+		PrevLink  string
+		NextLink  string
+		Servers   []*ServerInfo
+		Refresh   int  // 自动刷新间隔 (秒)，0 表示不刷新
+		Live      bool // 通过 SSE 实时更新，此时不输出 meta refresh
+	}{
+		Count:     count,
+		Total:     total,
+		Stats:     stats,
+		Query:     query,
+		Sort:      key,
+		Desc:      desc,
+		SortLinks: sortLinks(query, key, desc),
+		Paged:     paged,
+		Page:      page,
+		Servers:   list,
+		Refresh:   int(config.RefreshInterval / time.Second),
+		Live:      config.LiveUpdates,
+	}
+	if paged {
+		if page.Page > 1 {
+			data.PrevLink = pageLink(query, page.Page-1)
+		}
+		if page.Page < page.Pages {
+			data.NextLink = pageLink(query, page.Page+1)
+		}
+	}
+
+	// 整页刷新时允许缓存到下一次刷新为止，实时更新时数据靠 SSE 推送，页面本身不缓存
+	if !data.Live && data.Refresh > 0 {
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(data.Refresh))
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	renderPage(w, listTmpl, "list", data)
+}
+
+// maxRenderCacheEntries 渲染缓存最多保存的 URL 数，已满时新的 URL 不缓存，
+// 防止随意拼接查询参数撑大缓存
+const maxRenderCacheEntries = 256
+
+// renderCaches 首页和 /api/servers 的渲染缓存，在清理循环中删除过期的记录
+var renderCaches = &renderCache{entries: make(map[string]*cachedResponse)}
+
+// renderCache 按完整 URL 缓存渲染好的响应。同一 URL 的并发请求只渲染一次，
+// 其余请求等待并复用结果；超过 -render-cache-ttl 或列表发生变化 (events.Version 改变) 后失效。
+type renderCache struct {
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+// cachedResponse 一次渲染的结果，ready 关闭后其余字段不再改变
+type cachedResponse struct {
+	ready   chan struct{}
+	version uint64
+	expires time.Time
+
+	code   int
+	header http.Header
+	body   []byte
+}
+
+// acquire 返回 key 对应的有效缓存；没有时登记一个新的条目，owner 为 true 表示由调用方负责渲染。
+// 缓存已满时返回 nil，调用方直接渲染。
+func (c *renderCache) acquire(key string, version uint64) (entry *cachedResponse, owner bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if e, ok := c.entries[key]; ok && e.version == version && now.Before(e.expires) {
+		return e, false
+	}
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= maxRenderCacheEntries {
+		c.purgeLocked(now)
+		if len(c.entries) >= maxRenderCacheEntries {
+			return nil, false
+		}
+	}
+	e := &cachedResponse{ready: make(chan struct{}), version: version, expires: now.Add(config.RenderCacheTTL)}
+	c.entries[key] = e
+	return e, true
+}
+
+// drop 删除 key 对应的条目，只在条目仍是 e 时删除，不影响之后登记的新条目
+func (c *renderCache) drop(key string, e *cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[key] == e {
+		delete(c.entries, key)
+	}
+}
+
+// purge 删除过期的缓存
+func (c *renderCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.purgeLocked(time.Now())
+}
+
+func (c *renderCache) purgeLocked(now time.Time) {
+	for key, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// responseRecorder 把处理函数的输出记录到内存，供渲染缓存保存
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header         { return r.header }
+func (r *responseRecorder) Write(b []byte) (int, error) { return r.body.Write(b) }
+func (r *responseRecorder) WriteHeader(code int)        { r.code = code }
+
+// writeTo 把缓存的响应写给客户端，外层中间件已经设置的响应头 (Vary 等) 保留
+func (e *cachedResponse) writeTo(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range e.header {
+		h[k] = append(h[k], v...)
+	}
+	w.WriteHeader(e.code)
+	w.Write(e.body)
+}
+
+// withRenderCache 为 GET 请求加上渲染缓存，管理员的 ?showall=1 视图不缓存。
+// 放在 withGzip 和 withCORS 之内，缓存的是未压缩的响应体。
+func withRenderCache(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.RenderCacheTTL <= 0 || r.Method != http.MethodGet || r.URL.Query().Get("showall") == "1" {
+			next(w, r)
+			return
+		}
+		key := r.URL.RequestURI()
+		entry, owner := renderCaches.acquire(key, events.Version())
+		if entry == nil {
+			next(w, r)
+			return
+		}
+		if !owner {
+			select {
+			case <-entry.ready:
+				entry.writeTo(w)
+			case <-r.Context().Done():
+			}
+			return
+		}
+
+		rec := &responseRecorder{header: make(http.Header), code: http.StatusOK}
+		defer func() {
+			// 处理函数 panic 时同样唤醒等待的请求，让它们返回 500，并丢弃这一条
+			if entry.header == nil {
+				entry.code, entry.header = http.StatusInternalServerError, http.Header{}
+				renderCaches.drop(key, entry)
+				close(entry.ready)
+			}
+		}()
+		next(rec, r)
+		entry.code, entry.header, entry.body = rec.code, rec.header, rec.body.Bytes()
+		close(entry.ready)
+		// 只缓存成功的响应，等待中的请求仍然收到这一次的结果
+		if rec.code != http.StatusOK {
+			renderCaches.drop(key, entry)
+		}
+		entry.writeTo(w)
+	}
+}
+
+// pageBufferPool 复用渲染页面的缓冲区
+var pageBufferPool = sync.Pool{New: func() any { return new(bytes.Buffer) }}
+
+// renderPage 先把模板渲染到缓冲区，成功后再写给客户端；
+// 渲染失败时还没有发送任何内容，记录日志并返回 500，而不是输出半个页面
+func renderPage(w http.ResponseWriter, tmpl *template.Template, page string, data any) {
+	buf := pageBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer pageBufferPool.Put(buf)
+
+	if err := tmpl.Execute(buf, data); err != nil {
+		slog.Error("Rendering page failed", "page", page, "err", err)
+		w.Header().Del("Cache-Control")
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if _, err := buf.WriteTo(w); err != nil {
+		slog.Debug("Page response failed", "page", page, "err", err)
+	}
+}
+
+// handleFavicon 返回内嵌的站点图标，浏览器会自动请求 /favicon.ico
+func handleFavicon(w http.ResponseWriter, r *http.Request) {
+	data, err := staticFS.ReadFile("static/favicon.ico")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/x-icon")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(data)
+}
+
+// handleHealthz 存活/就绪探针，没有任何 UDP 监听就绪时返回 503
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	count := manager.Len()
+
+	status, code := "ok", http.StatusOK
+	if udpListeners.Load() == 0 {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(struct {
+		Status  string `json:"status"`
+		Servers int    `json:"servers"`
+		Uptime  string `json:"uptime"`
+	}{
+		Status:  status,
+		Servers: count,
+		Uptime:  time.Since(startTime).Round(time.Second).String(),
+	})
+}
+
+// serverStats 服务器列表的汇总数据
+type serverStats struct {
+	Servers       int     `json:"servers"`
+	Players       int     `json:"players"`
+	Bots          int     `json:"bots"`
+	Capacity      int     `json:"capacity"`
+	TopMap        string  `json:"topMap"`
+	TopMapPlayers int     `json:"topMapPlayers"`
+	AvgPingMs     float64 `json:"avgPingMs"`
+
+	ChattyServers []string `json:"chattyServers"` // 心跳间隔短于 chattyHeartbeatInterval 的服务器
+
+	UniqueIPs  int         `json:"uniqueIPs"`  // 服务器分布在多少个不同的 IP 上
+	CrowdedIPs []ipServers `json:"crowdedIPs"` // 服务器数达到 -crowded-ip-servers 的 IP，多的在前
+}
+
+// ipServers 同一 IP 上的服务器数量
+type ipServers struct {
+	IP      string `json:"ip"`
+	Servers int    `json:"servers"`
+}
+
+// chattyHeartbeatInterval 正常服务器每隔几分钟才发一次心跳，间隔低于该值视为异常
+const chattyHeartbeatInterval = 10 * time.Second
+
+// computeStats 汇总列表中的人数、容量、最热门的地图和平均延迟，并列出心跳过于频繁的服务器
+// 以及承载服务器过多的 IP。
+// 热门地图按玩家总数，其次按服务器数量，再按名称决定；平均延迟只统计已测得延迟的服务器。
+func computeStats(list []*ServerInfo) serverStats {
+	st := serverStats{Servers: len(list), ChattyServers: []string{}, CrowdedIPs: []ipServers{}}
+	mapPlayers := make(map[string]int)
+	mapServers := make(map[string]int)
+	ipCount := make(map[string]int)
+	var pingTotal time.Duration
+	pinged := 0
+	for _, s := range list {
+		st.Players += s.Players
+		st.Bots += s.Bots
+		st.Capacity += s.MaxPlayers
+		if s.Map != "" {
+			mapPlayers[s.Map] += s.Players
+			mapServers[s.Map]++
+		}
+		if s.Ping > 0 {
+			pingTotal += s.Ping
+			pinged++
+		}
+		if s.HeartbeatCount > 1 && s.LastHeartbeatInterval < chattyHeartbeatInterval {
+			st.ChattyServers = append(st.ChattyServers, s.Address)
+		}
+		ipCount[addressIP(s.Address)]++
+	}
+	sort.Strings(st.ChattyServers)
+	st.UniqueIPs = len(ipCount)
+	if config.CrowdedIPServers > 0 {
+		for ip, n := range ipCount {
+			if n >= config.CrowdedIPServers {
+				st.CrowdedIPs = append(st.CrowdedIPs, ipServers{ip, n})
+			}
+		}
+		sort.Slice(st.CrowdedIPs, func(i, j int) bool {
+			a, b := st.CrowdedIPs[i], st.CrowdedIPs[j]
+			if a.Servers != b.Servers {
+				return a.Servers > b.Servers
+			}
+			return a.IP < b.IP
+		})
+	}
+	for m, players := range mapPlayers {
+		best := st.TopMap == "" ||
+			players > st.TopMapPlayers ||
+			players == st.TopMapPlayers && (mapServers[m] > mapServers[st.TopMap] ||
+				mapServers[m] == mapServers[st.TopMap] && m < st.TopMap)
+		if best {
+			st.TopMap, st.TopMapPlayers = m, players
+		}
+	}
+	if pinged > 0 {
+		ms := float64(pingTotal) / float64(pinged) / float64(time.Millisecond)
+		st.AvgPingMs = math.Round(ms*10) / 10
+	}
+	return st
+}
+
+// handleStats 以 JSON 返回服务器列表的汇总数据，基于同一份快照计算，并附带最近一轮查询的耗时
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	list := visibleServers(snapshotServers(), r)
+	writeJSON(w, http.StatusOK, struct {
+		serverStats
+		Cycle cycleInfo `json:"cycle"`
+	}{computeStats(list), queryCycle.snapshot()})
+}
+
+// mapGroup 当前在同一张地图上的服务器
+type mapGroup struct {
+	Map     string        `json:"map"`
+	Players int           `json:"players"`
+	Servers []*ServerInfo `json:"servers"`
+}
+
+// groupByMap 按地图分组，服务器多的地图在前，相同时按玩家数和地图名排序；
+// 组内保持 list 原有的顺序。尚未查询到地图的服务器不计入。
+func groupByMap(list []*ServerInfo) []mapGroup {
+	index := make(map[string]int)
+	groups := []mapGroup{}
+	for _, s := range list {
+		if s.Map == "" {
+			continue
+		}
+		i, ok := index[s.Map]
+		if !ok {
+			i = len(groups)
+			index[s.Map] = i
+			groups = append(groups, mapGroup{Map: s.Map})
+		}
+		groups[i].Servers = append(groups[i].Servers, s)
+		groups[i].Players += s.Players
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		a, b := groups[i], groups[j]
+		if len(a.Servers) != len(b.Servers) {
+			return len(a.Servers) > len(b.Servers)
+		}
+		if a.Players != b.Players {
+			return a.Players > b.Players
+		}
+		return a.Map < b.Map
+	})
+	return groups
+}
+
+// handleByMap 按地图分组显示服务器，支持与列表页相同的筛选和排序参数
+func handleByMap(w http.ResponseWriter, r *http.Request) {
+	list, _ := listServers(r)
+	renderPage(w, byMapTmpl, "bymap", groupByMap(list))
+}
+
+// handleAPIByMap 以 JSON 返回按地图分组的服务器: [{map, players, servers}]
+func handleAPIByMap(w http.ResponseWriter, r *http.Request) {
+	list, _ := listServers(r)
+	writeJSON(w, http.StatusOK, groupByMap(list))
+}
+
+// detailStaleAfter 打开详情页时，玩家列表超过该时间没有刷新就排队补查一次
+const detailStaleAfter = 30 * time.Second
+
+// detailHistoryRows 详情页显示的最近采样数
+const detailHistoryRows = 20
+
+// handleServerDetail 显示单个服务器的详情页: /server?addr=ip:port
+func handleServerDetail(w http.ResponseWriter, r *http.Request) {
+	addr := r.URL.Query().Get("addr")
+
+	info, ok := manager.Get(addr)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	// 玩家列表或参数过期时交给 worker 池补查，页面先显示已有的结果，刷新后即可看到新数据。
+	// 请求时间不论查询成败都会记录，detailStaleAfter 内不再重复排队，同时打开的页面只有一个会排队
+	if time.Since(info.PlayersUpdated) > detailStaleAfter || time.Since(info.RulesUpdated) > rulesRefreshInterval {
+		requested := false
+		manager.Update(addr, func(target *ServerInfo) {
+			if time.Since(target.RefreshRequested) > detailStaleAfter {
+				target.RefreshRequested = time.Now()
+				requested = true
+			}
+		})
+		if requested {
+			queries.enqueue(addr)
+		}
+	}
+
+	// 最近的采样倒序显示，更早的记录通过 /api/history 获取
+	recent := info.History.Samples()
+	if len(recent) > detailHistoryRows {
+		recent = recent[len(recent)-detailHistoryRows:]
+	}
+	for i, j := 0, len(recent)-1; i < j; i, j = i+1, j-1 {
+		recent[i], recent[j] = recent[j], recent[i]
+	}
+	data := struct {
+		ServerInfo
+		Recent []historyPoint
+	}{info, recent}
+
+	renderPage(w, detailTmpl, "detail", data)
+}
+
+// compactColumns ?compact=1 时每行数组的列，作为第一行输出
+var compactColumns = []any{"address", "name", "map", "players", "maxPlayers", "bots", "countryCode", "ping"}
+
+// compactRows 把服务器列表转换为表头加数组行的紧凑格式，延迟以毫秒表示
+func compactRows(list []*ServerInfo) [][]any {
+	rows := make([][]any, 0, len(list)+1)
+	rows = append(rows, compactColumns)
+	for _, s := range list {
+		rows = append(rows, []any{s.Address, s.Name, s.Map, s.Players, s.MaxPlayers, s.Bots, s.CountryCode, s.Ping.Milliseconds()})
+	}
+	return rows
+}
+
+// handleAPIServers 以 JSON 格式返回服务器列表，?pretty=1 输出缩进格式。
+// 带 ?page= 或 ?limit= 时返回 {total, page, pages, limit, servers} 对象。
+// ?compact=1 时每个服务器是一个数组，第一行是列名，适合流量敏感的客户端。
+func handleAPIServers(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	list, _ := listServers(r)
+	list, page, paged := paginate(list, query)
+	var body any = list
+	if query.Get("compact") == "1" {
+		body = compactRows(list)
+	}
+	if paged {
+		body = struct {
+			pageInfo
+			Servers any `json:"servers"`
+		}{page, body}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	if query.Get("pretty") == "1" {
+		enc.SetIndent("", "  ")
+	}
+	if err := enc.Encode(body); err != nil {
+		slog.Debug("API response failed", "err", err)
+	}
+}
+
+// handleAPIListText 以纯文本输出服务器地址，每行一个 ip:port，供只认这种格式的工具使用: /api/list.txt。
+// 与 Master 列表一样只包含已验证的服务器，支持与 /api/servers 相同的筛选和排序参数。
+func handleAPIListText(w http.ResponseWriter, r *http.Request) {
+	list, _ := listServers(r)
+	var b strings.Builder
+	for _, s := range list {
+		if s.Listed {
+			b.WriteString(s.Address)
+			b.WriteByte('\n')
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, b.String())
+}
+
+// handleAPIPlayers 返回单个服务器的玩家列表: /api/players?addr=ip:port
+func handleAPIPlayers(w http.ResponseWriter, r *http.Request) {
+	addr := r.URL.Query().Get("addr")
+
+	s, ok := manager.Get(addr)
+	if !ok {
+		http.Error(w, "server not found", http.StatusNotFound)
+		return
+	}
+	players := s.PlayerList
+	if players == nil {
+		players = []Player{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(players); err != nil {
+		slog.Debug("API response failed", "err", err)
+	}
+}
+
+// gzipWriterPool 复用 gzip.Writer，避免每个请求重新分配压缩缓冲
+var gzipWriterPool = sync.Pool{
+	New: func() any { return gzip.NewWriter(io.Discard) },
+}
+
+// withGzip 在客户端支持时以 gzip 压缩响应。
+// SSE (/events) 和 /api/stream 依赖逐条 Flush，不使用这个包装。
+func withGzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if r.Method == http.MethodHead || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+			next(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		next(gw, r)
+	}
+}
+
+// acceptsGzip 解析 Accept-Encoding，gzip;q=0 视为不接受
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, err := strconv.ParseFloat(v, 64)
+			return err == nil && q > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter 把响应体写入 gzip 流。状态码不允许响应体 (1xx/204/304) 时不压缩。
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func (g *gzipResponseWriter) WriteHeader(code int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	if code >= 200 && code != http.StatusNoContent && code != http.StatusNotModified {
+		h := g.Header()
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		g.gz = gzipWriterPool.Get().(*gzip.Writer)
+		g.gz.Reset(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(code)
+}
+
+func (g *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		// 按压缩前的内容推断类型，否则 net/http 会把它识别成 gzip 数据
+		if g.Header().Get("Content-Type") == "" {
+			g.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.gz == nil {
+		return g.ResponseWriter.Write(b)
+	}
+	return g.gz.Write(b)
+}
+
+// close 写入 gzip 结尾并归还 Writer
+func (g *gzipResponseWriter) close() {
+	if g.gz == nil {
+		return
+	}
+	if err := g.gz.Close(); err != nil {
+		slog.Debug("gzip response incomplete", "err", err)
+	}
+	gzipWriterPool.Put(g.gz)
+	g.gz = nil
+}
+
+// withCORS 在设置了 -cors-origin 时为 API 输出 CORS 头，并直接应答 OPTIONS 预检请求。
+// 请求的 Origin 不在允许列表中时不输出任何 CORS 头，由浏览器拒绝。
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if config.CORSOrigin == "" || origin == "" {
+			next(w, r)
+			return
+		}
+		allowed := ""
+		for _, o := range strings.Split(config.CORSOrigin, ",") {
+			o = strings.TrimSpace(o)
+			if o == "*" || strings.EqualFold(o, origin) {
+				allowed = o
+				break
+			}
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		if allowed == "" {
+			next(w, r)
+			return
+		}
+		if allowed == "*" {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			h.Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			h.Set("Access-Control-Max-Age", "86400")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// requireAdmin 校验管理令牌，支持 Authorization: Bearer <token> 或 ?token=，只接受 methods 中的方法
+func requireAdmin(next http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.AdminToken == "" {
+			http.NotFound(w, r)
+			return
+		}
+		if !adminAuthorized(r) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid admin token"})
+			return
+		}
+		allowed := false
+		for _, m := range methods {
+			allowed = allowed || r.Method == m
+		}
+		if !allowed {
+			w.Header().Set("Allow", strings.Join(methods, ", "))
+			writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminAuthorized 检查请求是否携带正确的管理令牌，未配置令牌时总是返回 false
+func adminAuthorized(r *http.Request) bool {
+	if config.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.URL.Query().Get("token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) == 1
+}
+
+// adminResult 管理接口的返回内容
+type adminResult struct {
+	Action  string   `json:"action"`
+	Address string   `json:"address"`
+	Removed []string `json:"removed"`
+}
+
+// handleAdminRemove 立即移除一个服务器: POST /admin/remove?addr=ip:port
+func handleAdminRemove(w http.ResponseWriter, r *http.Request) {
+	addr := r.URL.Query().Get("addr")
+
+	s, ok := manager.Remove(addr)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "server not found"})
+		return
+	}
+	slog.Info("Server removed by admin", "addr", addr)
+	events.Publish(eventRemoved, addr, s.Name)
+	writeJSON(w, http.StatusOK, adminResult{Action: "remove", Address: addr, Removed: []string{addr}})
+}
+
+// handleAdminBan 封禁服务器 IP 并移除该 IP 下的所有条目: POST /admin/ban?addr=ip[:port]&reason=
+func handleAdminBan(w http.ResponseWriter, r *http.Request) {
+	ip := addressIP(r.URL.Query().Get("addr"))
+	if _, err := netip.ParseAddr(ip); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid address"})
+		return
+	}
+
+	banlist.mu.Lock()
+	banlist.m[ip] = banEntry{Time: time.Now(), Reason: r.URL.Query().Get("reason")}
+	banlist.mu.Unlock()
+	persistBans()
+
+	removed := []string{}
+	for _, s := range manager.RemoveFunc(func(s *ServerInfo) bool { return addressIP(s.Address) == ip }) {
+		removed = append(removed, s.Address)
+		events.Publish(eventRemoved, s.Address, s.Name)
+	}
+	slog.Info("Server banned by admin", "ip", ip, "removed", len(removed))
+	sort.Strings(removed)
+	writeJSON(w, http.StatusOK, adminResult{Action: "ban", Address: ip, Removed: removed})
+}
+
+// handleAdminBans 查看或解除封禁:
+// GET /admin/bans 返回 [{ip, time, reason}]，DELETE /admin/bans?addr=ip 解除封禁
+func handleAdminBans(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, bannedIPs())
+		return
+	}
+
+	ip := addressIP(r.URL.Query().Get("addr"))
+	banlist.mu.Lock()
+	_, ok := banlist.m[ip]
+	delete(banlist.m, ip)
+	banlist.mu.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "address not banned"})
+		return
+	}
+	persistBans()
+	slog.Info("Server unbanned by admin", "ip", ip)
+	writeJSON(w, http.StatusOK, adminResult{Action: "unban", Address: ip, Removed: []string{}})
+}
+
+// handleAdminBlackhole 查看或解除因无效数据包被临时屏蔽的 IP:
+// GET /admin/blackhole 返回 [{ip, since, until, packets, dropped}]，DELETE /admin/blackhole?addr=ip 解除屏蔽
+func handleAdminBlackhole(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		writeJSON(w, http.StatusOK, scanners.List())
+		return
+	}
+
+	ip := addressIP(r.URL.Query().Get("addr"))
+	if !scanners.Lift(ip) {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "address not blackholed"})
+		return
+	}
+	slog.Info("Blackhole lifted by admin", "ip", ip)
+	writeJSON(w, http.StatusOK, adminResult{Action: "unblackhole", Address: ip, Removed: []string{}})
+}
+
+// rawQueryResult /admin/raw-query 的结果，Hex 为 hex.Dump 格式的原始回复 (分片已重组)
+type rawQueryResult struct {
+	Address    string `json:"address"`
+	Type       string `json:"type"`
+	PingMs     int64  `json:"pingMs,omitempty"`
+	Length     int    `json:"length"`
+	Hex        string `json:"hex"`
+	Parsed     any    `json:"parsed,omitempty"`
+	ParseError string `json:"parseError,omitempty"`
+}
+
+// handleAdminRawQuery 立即查询任意地址并返回原始回复和解析结果，用于排查解析错误的服务器:
+// GET /admin/raw-query?addr=ip:port&type=info|players|rules，默认 info。不会注册或更新服务器。
+func handleAdminRawQuery(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	ap, err := netip.ParseAddrPort(query.Get("addr"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid address"})
+		return
+	}
+	addr := netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String()
+	result := rawQueryResult{Address: addr, Type: query.Get("type")}
+	if result.Type == "" {
+		result.Type = "info"
+	}
+
+	var resp []byte
+	switch result.Type {
+	case "info":
+		var ping time.Duration
+		resp, ping, err = fetchA2SInfo(dialA2S, addr, config.QueryTimeout)
+		result.PingMs = ping.Milliseconds()
+	case "players":
+		resp, err = challengeQuery(addr, config.QueryTimeout, 0x55)
+	case "rules":
+		resp, err = challengeQuery(addr, config.QueryTimeout, 0x56)
+	default:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "type must be info, players or rules"})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+		return
+	}
+	result.Length = len(resp)
+	result.Hex = hex.Dump(resp)
+
+	var parsed any
+	switch {
+	case result.Type == "info":
+		var info ServerInfo
+		if info, err = parseA2SInfo(resp); err == nil {
+			parsed = info
+		}
+	case len(resp) < 6:
+		err = errors.New("response too short")
+	case result.Type == "players" && resp[4] == 0x44:
+		parsed, err = parsePlayers(newPacketReader(resp[5:]))
+	case result.Type == "rules" && resp[4] == 0x45:
+		parsed, err = parseRules(newPacketReader(resp[5:]))
+	default:
+		err = fmt.Errorf("unexpected header 0x%02X", resp[4])
+	}
+	if err != nil {
+		result.ParseError = err.Error()
+	} else {
+		result.Parsed = parsed
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// writeJSON 以指定状态码输出 JSON
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Debug("API response failed", "err", err)
+	}
+}
+
+// handleAPIHistory 返回单个服务器最近的人数采样: /api/history?addr=ip:port
+func handleAPIHistory(w http.ResponseWriter, r *http.Request) {
+	addr := r.URL.Query().Get("addr")
+
+	s, ok := manager.Get(addr)
+	if !ok {
+		http.Error(w, "server not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, s.History.Samples())
+}
+
+// apiQueryLimiter 限制每个客户端 IP 调用 /api/query 的频率，避免被用来反复查询已注册的服务器
+var apiQueryLimiter = newRateLimiter(5*time.Second, 3)
+
+// apiQueryWait /api/query 等待查询完成的最长时间
+const apiQueryWait = 10 * time.Second
+
+// handleAPIQuery 立即查询一个服务器并返回最新信息: /api/query?addr=ip:port。
+// 只接受已注册的服务器；带 &add=1 时先注册再查询，由于会向任意地址发包，需要管理令牌。
+// 不带管理令牌的请求按客户端 IP 限速。
+func handleAPIQuery(w http.ResponseWriter, r *http.Request) {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if !adminAuthorized(r) && !apiQueryLimiter.Allow(client) {
+		w.Header().Set("Retry-After", "5")
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many requests"})
+		return
+	}
+
+	query := r.URL.Query()
+	ap, err := netip.ParseAddrPort(query.Get("addr"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid address"})
+		return
+	}
+	addr := netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String()
+
+	if _, ok := manager.Get(addr); !ok {
+		if query.Get("add") != "1" {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "server not found"})
+			return
+		}
+		if !adminAuthorized(r) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid admin token"})
+			return
+		}
+		registerServer(addr, "", nil)
+	}
+
+	// 与后台查询共用 worker 池，遵守 -queries-per-ip；等待超时时返回已有的信息，查询仍在队列中
+	done, queued := queries.enqueueWait(addr)
+	if !queued {
+		w.Header().Set("Retry-After", "5")
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": "query queue busy"})
+		return
+	}
+	wait := time.NewTimer(apiQueryWait)
+	defer wait.Stop()
+	select {
+	case <-done:
+	case <-wait.C:
+	case <-r.Context().Done():
+		return
+	}
+
+	// 查询失败时返回的是已有的 (已标记失败原因的) 信息
+	info, ok := manager.Get(addr)
+	// 查询期间被清理，或者地址已被封禁/不在允许的游戏中
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "server not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// verifyLimiter 限制每个客户端 IP 调用 /api/verify 的频率，避免被用来向任意地址发包
+var verifyLimiter = newRateLimiter(5*time.Second, 3)
+
+// verifyResult /api/verify 的检查结果，可达时 Info 为本次查询到的信息
+type verifyResult struct {
+	Address   string      `json:"address"`
+	Reachable bool        `json:"reachable"`
+	Error     string      `json:"error,omitempty"`
+	Info      *ServerInfo `json:"info,omitempty"`
+}
+
+// handleAPIVerify 供 "添加服务器" 表单在提交前检查地址: POST /api/verify {"address":"ip:port"}。
+// 只做一次 A2S_INFO 查询，不会注册服务器；已封禁的 IP 和 (未开启 -allow-private 时) 私有地址直接拒绝。
+func handleAPIVerify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	if !verifyLimiter.Allow(client) {
+		w.Header().Set("Retry-After", "5")
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": "too many requests"})
+		return
+	}
+
+	var req struct {
+		Address string `json:"address"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid JSON body"})
+		return
+	}
+	ap, err := netip.ParseAddrPort(strings.TrimSpace(req.Address))
+	if err != nil || ap.Port() == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid address"})
+		return
+	}
+	addr := netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()).String()
+	if isBanned(addr) {
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": "address banned"})
+		return
+	}
+	if !config.AllowPrivate && isPrivateAddress(addr) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "private address"})
+		return
+	}
+
+	result := verifyResult{Address: addr}
+	info, err := queryServerInfo(dialA2S, addr, config.QueryTimeout)
+	if err != nil {
+		result.Error = err.Error()
+		writeJSON(w, http.StatusOK, result)
+		return
+	}
+	result.Reachable = true
+	result.Info = info
+	if !gameAllowed(info.GameDir) {
+		// 能连通，但游戏不在 -allowed-games 中，注册后会被移除
+		result.Error = "game not allowed"
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleAPIRaw 以 Master 回复相同的打包格式导出全部已验证的服务器，用于备份或给备用 Master 导入。
+// 默认每条 6 字节 (IPv4 + 端口，大端序)，只含 IPv4；?ipv6=1 时每条 18 字节并包含 IPv6 服务器。
+// 只输出地址部分，不含回复头和 0.0.0.0:0 结束标记。
+func handleAPIRaw(w http.ResponseWriter, r *http.Request) {
+	ipv6 := r.URL.Query().Get("ipv6") == "1"
+	list := listedAddrs(ipv6, nil)
+	entrySize := 6
+	if ipv6 {
+		entrySize = 18
+	}
+	body := make([]byte, 0, len(list)*entrySize)
+	for _, ap := range list {
+		body = appendAddrPort(body, ap, ipv6)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="servers.bin"`)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.Write(body)
+}
+
+// listServers 复制服务器列表并按请求参数筛选和排序，同时返回筛选前的数量
+func listServers(r *http.Request) ([]*ServerInfo, int) {
+	list := visibleServers(snapshotServers(), r)
+	return selectServers(list, r.URL.Query()), len(list)
+}
+
+// selectServers 按请求参数筛选、排序和去重已复制的列表。
+// 需要同时输出汇总数据时，调用方先用同一份列表计算 computeStats，再调用它
+func selectServers(list []*ServerInfo, query url.Values) []*ServerInfo {
+	list = filterServers(list, query)
+	key, desc := sortParams(query)
+	sortServers(list, key, desc)
+	if query.Get("dedup") == "1" {
+		list = dedupServers(list)
+	}
+	return list
+}
+
+// sseMinInterval 两次推送的最小间隔，合并一轮查询中产生的大量变化
+const sseMinInterval = time.Second
+
+// sseKeepAlive 没有变化时发送注释行的间隔，防止代理断开空闲连接
+const sseKeepAlive = 15 * time.Second
+
+// sseWriteTimeout 单次写入 SSE 数据的超时，客户端停止读取时及时释放连接
+const sseWriteTimeout = 10 * time.Second
+
+// sseReconnectDelay 连接到期关闭时建议浏览器等待的重连间隔
+const sseReconnectDelay = 2 * time.Second
+
+// sseClients 当前连接 /events 的客户端数
+var sseClients atomic.Int32
+
+// handleEvents 以 Server-Sent Events 推送服务器列表，
+// 查询参数与 /api/servers 相同，列表变化时发送 servers 事件。
+// 连接超过 -sse-max-age 后发送 reconnect 事件并关闭，浏览器随后自动重连。
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	_, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	if n := sseClients.Add(1); config.SSEMaxClients > 0 && int(n) > config.SSEMaxClients {
+		sseClients.Add(-1)
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "too many event stream clients", http.StatusServiceUnavailable)
+		return
+	}
+	defer sseClients.Add(-1)
+
+	// 每次写入前设置截止时间，不支持时 (例如被其他中间件包装) 忽略错误
+	rc := http.NewResponseController(w)
+	write := func(format string, args ...any) error {
+		rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	var expired <-chan time.Time
+	if config.SSEMaxAge > 0 {
+		timer := time.NewTimer(config.SSEMaxAge)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	// 先订阅再发送首个列表，避免漏掉中间的变化
+	ch := events.Subscribe(64)
+	defer events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	query := r.URL.Query()
+	send := func() error {
+		// 汇总数据和列表来自同一份快照，两者不会不一致
+		list := visibleServers(snapshotServers(), r)
+		total := len(list)
+		stats := computeStats(list)
+		list = pinFirst(selectServers(list, query))
+		count := len(list)
+		list, _, _ = paginate(list, query)
+		servers := make([]eventServer, len(list))
+		for i, s := range list {
+			servers[i] = eventServer{s}
+		}
+		data, err := json.Marshal(struct {
+			Total   int           `json:"total"`
+			Count   int           `json:"count"`
+			Stats   serverStats   `json:"stats"`
+			Servers []eventServer `json:"servers"`
+		}{total, count, stats, servers})
+		if err != nil {
+			return err
+		}
+		return write("event: servers\ndata: %s\n\n", data)
+	}
+	if err := send(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sseMinInterval)
+	defer ticker.Stop()
+	dirty := false
+	lastWrite := time.Now()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-expired:
+			write("retry: %d\nevent: reconnect\ndata: {}\n\n", sseReconnectDelay.Milliseconds())
+			return
+		case <-ch:
+			dirty = true
+		case <-ticker.C:
+			switch {
+			case dirty:
+				if err := send(); err != nil {
+					return
+				}
+				dirty = false
+				lastWrite = time.Now()
+			case time.Since(lastWrite) >= sseKeepAlive:
+				if err := write(": keep-alive\n\n"); err != nil {
+					return
+				}
+				lastWrite = time.Now()
+			}
+		}
+	}
+}
+
+// streamQueueSize /api/stream 每个连接缓冲的事件数，客户端读取太慢时丢弃新事件
+const streamQueueSize = 256
+
+// handleStream 以 JSON Lines 格式逐条输出服务器列表的变化事件，类似 docker events。
+// 与 SSE 共用同一个事件源，客户端断开或服务关闭时结束。
+func handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ch := events.Subscribe(streamQueueSize)
+	defer events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// 与 /events 相同，每次写入前重新设置截止时间，不受 -http-write-timeout 限制
+	rc := http.NewResponseController(w)
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleAPIEvents 返回最近的服务器上线/下线记录: GET /api/events?since=<RFC3339>，
+// 不带 since 时返回保留的全部记录 (最多 eventLogSize 条)，供定时轮询的面板使用
+func handleAPIEvents(w http.ResponseWriter, r *http.Request) {
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid since, expected RFC3339 time"})
+			return
+		}
+		since = t
+	}
+	writeJSON(w, http.StatusOK, events.Since(since))
+}
+
+// snapshotServers 在读锁内复制一份服务器列表，释放锁后可安全读取
+func snapshotServers() []*ServerInfo {
+	list := manager.Snapshot()
+	sortServers(list, "lastseen", true)
+	return list
+}
+
+// visibleServers 按 -hide-pending、-hide-empty 和 -min-real-players 过滤公开显示的列表，
+// 管理员带 ?showall=1 时返回全部服务器
+func visibleServers(list []*ServerInfo, r *http.Request) []*ServerInfo {
+	if r.URL.Query().Get("showall") == "1" && adminAuthorized(r) {
+		return list
+	}
+	if config.HidePending {
+		list = listedOnly(list)
+	}
+	out := list[:0]
+	for _, s := range list {
+		if !belowPlayerThreshold(s) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// belowPlayerThreshold 报告服务器的真人玩家数是否低于 -hide-empty / -min-real-players 的要求，
+// 这类服务器仍然被查询和记录，只是不出现在公开列表中。置顶服务器总是显示。
+func belowPlayerThreshold(s *ServerInfo) bool {
+	threshold := config.MinRealPlayers
+	if config.HideEmpty && threshold < 1 {
+		threshold = 1
+	}
+	return threshold > 0 && !s.Pinned && s.Players-s.Bots < threshold
+}
+
+// listedOnly 过滤掉尚未验证的服务器
+func listedOnly(list []*ServerInfo) []*ServerInfo {
+	out := list[:0]
+	for _, s := range list {
+		if s.Listed {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// filterServers 按请求参数筛选列表:
+// ?q= 名称或地图包含关键字 (不区分大小写)，?map= 地图完全匹配，
+// ?country= 国家代码或名称，?minplayers= 最少人数，?tag= 带有该标签 (不区分大小写)，
+// ?game= 游戏描述包含关键字或游戏目录完全匹配 (不区分大小写)
+func filterServers(list []*ServerInfo, query url.Values) []*ServerInfo {
+	keyword := strings.ToLower(strings.TrimSpace(query.Get("q")))
+	mapName := strings.TrimSpace(query.Get("map"))
+	game := strings.ToLower(strings.TrimSpace(query.Get("game")))
+	country := strings.TrimSpace(query.Get("country"))
+	minPlayers, _ := strconv.Atoi(query.Get("minplayers"))
+	tag := strings.TrimSpace(query.Get("tag"))
+	if keyword == "" && mapName == "" && game == "" && country == "" && minPlayers <= 0 && tag == "" {
+		return list
+	}
+
+	out := []*ServerInfo{}
+	for _, s := range list {
+		if keyword != "" &&
+			!strings.Contains(strings.ToLower(s.Name), keyword) &&
+			!strings.Contains(strings.ToLower(s.Map), keyword) {
+			continue
+		}
+		if mapName != "" && !strings.EqualFold(s.Map, mapName) {
+			continue
+		}
+		if game != "" && !strings.Contains(strings.ToLower(s.GameDesc), game) && !strings.EqualFold(s.GameDir, game) {
+			continue
+		}
+		if country != "" && !strings.EqualFold(s.CountryCode, country) && !strings.EqualFold(s.Country, country) {
+			continue
+		}
+		if s.Players < minPlayers {
+			continue
+		}
+		if tag != "" && !hasKeyword(s.Tags, tag) {
+			continue
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// dedupServers 隐藏同一 IP 上名称相同的重复条目，保留排序靠前的一条。
+// 只影响展示，manager.servers 不变；尚未查询到名称的服务器不参与合并。
+func dedupServers(list []*ServerInfo) []*ServerInfo {
+	seen := make(map[string]bool, len(list))
+	out := make([]*ServerInfo, 0, len(list))
+	for _, s := range list {
+		if s.Listed {
+			host := s.Address
+			if ap, err := netip.ParseAddrPort(s.Address); err == nil {
+				host = ap.Addr().Unmap().String()
+			}
+			key := host + "\x00" + strings.ToLower(strings.TrimSpace(s.Name))
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// 可排序的字段及其默认排序方向 (true 为倒序)
+var sortDefaults = map[string]bool{
+	"lastseen": true,
+	"players":  true,
+	"name":     false,
+	"map":      false,
+	"ping":     false,
+}
+
+// sortParams 读取 ?sort= 和 ?order=asc|desc，默认按最后更新时间倒序
+func sortParams(query url.Values) (key string, desc bool) {
+	key = strings.ToLower(query.Get("sort"))
+	desc, ok := sortDefaults[key]
+	if !ok {
+		key, desc = "lastseen", true
+	}
+	switch strings.ToLower(query.Get("order")) {
+	case "asc":
+		desc = false
+	case "desc":
+		desc = true
+	}
+	return key, desc
+}
+
+// sortLinks 生成表头链接，保留当前的筛选参数；点击当前排序列时切换方向
+func sortLinks(query url.Values, current string, desc bool) map[string]string {
+	links := make(map[string]string, len(sortDefaults))
+	for key, defaultDesc := range sortDefaults {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		order := defaultDesc
+		if key == current {
+			order = !desc
+		}
+		q.Set("sort", key)
+		q.Del("page")
+		if order {
+			q.Set("order", "desc")
+		} else {
+			q.Set("order", "asc")
+		}
+		links[key] = "?" + q.Encode()
+	}
+	return links
+}
+
+// 分页参数: 只给 ?page= 时每页的默认数量，以及 ?limit= 的上限
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 1000
+)
+
+// pageInfo 分页信息，Total 为分页前的条目数
+type pageInfo struct {
+	Total int `json:"total"`
+	Page  int `json:"page"`
+	Pages int `json:"pages"`
+	Limit int `json:"limit"`
+}
+
+// paginate 按 ?page= 和 ?limit= 截取列表，超出范围的页码收敛到首页或末页。
+// 两个参数都没有时返回完整列表，paged 为 false。
+func paginate(list []*ServerInfo, query url.Values) (page []*ServerInfo, info pageInfo, paged bool) {
+	if query.Get("page") == "" && query.Get("limit") == "" {
+		return list, pageInfo{}, false
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageLimit
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	pages := (len(list) + limit - 1) / limit
+	if pages < 1 {
+		pages = 1
+	}
+	n, _ := strconv.Atoi(query.Get("page"))
+	if n < 1 {
+		n = 1
+	}
+	if n > pages {
+		n = pages
+	}
+	start := (n - 1) * limit
+	end := start + limit
+	if end > len(list) {
+		end = len(list)
+	}
+	return list[start:end], pageInfo{Total: len(list), Page: n, Pages: pages, Limit: limit}, true
+}
+
+// pageLink 生成指定页码的链接，保留其他参数
+func pageLink(query url.Values, page int) string {
+	q := url.Values{}
+	for k, v := range query {
+		q[k] = v
+	}
+	q.Set("page", strconv.Itoa(page))
+	return "?" + q.Encode()
+}
+
+// sortServers 按指定字段排序，相同时按地址排序保证顺序稳定
+func sortServers(list []*ServerInfo, key string, desc bool) {
+	compare := func(a, b *ServerInfo) int {
+		switch key {
+		case "players":
+			return a.Players - b.Players
+		case "name":
+			return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+		case "map":
+			return strings.Compare(strings.ToLower(a.Map), strings.ToLower(b.Map))
+		case "ping":
+			switch {
+			case a.Ping < b.Ping:
+				return -1
+			case a.Ping > b.Ping:
+				return 1
+			}
+			return 0
+		}
+		return a.LastSeen.Compare(b.LastSeen)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		c := compare(list[i], list[j])
+		if c == 0 {
+			return list[i].Address < list[j].Address
+		}
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+// startCleanerAndQuery 定期清理离线服务器，并把在线服务器交给 pool 查询详情
+func startCleanerAndQuery(ctx context.Context, pool *queryPool, interval, serverTimeout time.Duration) {
+	defer pool.wait()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	queryCycle.schedule(interval, time.Now().Add(interval))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		queryCycle.begin(time.Now(), interval)
+
+		// 1. 删除超时未发送心跳或持续查询失败的服务器
+		removed := manager.RemoveFunc(func(s *ServerInfo) bool {
+			reason := removalReason(s, serverTimeout)
+			if reason != "" {
+				slog.Info("Server removed", "addr", s.Address, "reason", reason, "failures", s.FailCount)
+			}
+			return reason != ""
+		})
+		for _, s := range removed {
+			events.Publish(eventRemoved, s.Address, s.Name)
+		}
+
+		// 只复制需要查询的服务器地址，不持有锁去查询网络，防止阻塞
+		var checkList []string
+		deferred := 0
+		// 空服变化少，距上次查询不足 emptyEvery 轮时跳过；留出一轮的余量，
+		// 避免查询耗时让上次查询时间略晚于本轮开始而多等一轮
+		emptyEvery := time.Duration(config.EmptyQueryEvery-1) * interval
+		manager.Each(func(s *ServerInfo) {
+			// 心跳自带信息的服务器随每次心跳更新，不需要查询
+			if s.InlineInfo {
+				return
+			}
+			if emptyEvery > 0 && s.Listed && !s.Stale && s.FailCount == 0 && s.Players == 0 &&
+				time.Since(s.LastQueryTime) < emptyEvery {
+				deferred++
+				return
+			}
+			checkList = append(checkList, s.Address)
+		})
+		purgeChallenges()
+		heartbeatLimiter.purge()
+		challengeLimiter.purge()
+		masterQueryLimiter.purge()
+		malformedQueryLimiter.purge()
+		verifyLimiter.purge()
+		apiQueryLimiter.purge()
+		infoChallenges.purge()
+		scanners.purge()
+		renderCaches.purge()
+		verifiedClients.purge()
+		droppedQueryLog.purge()
+		if rdns != nil {
+			rdns.purge()
+		}
+
+		// 2. 查询服务器详情 (A2S_INFO) - 交给 worker 池，不等待查询完成
+		skipped := 0
+		for _, addr := range checkList {
+			if !pool.enqueue(addr) {
+				skipped++
+			}
+		}
+		if skipped > 0 {
+			slog.Warn("Query queue busy, servers skipped this round", "skipped", skipped)
+		}
+		queryCycle.dispatched(len(checkList)-skipped, skipped, deferred, len(removed))
+		if pool.idle() {
+			queryCycle.finish()
+		}
+	}
+}
+
+// removalReason 返回清理时应移除服务器的原因，不需要移除时返回空字符串
+func removalReason(s *ServerInfo, serverTimeout time.Duration) string {
+	if time.Since(s.LastSeen) > serverTimeout {
+		return "heartbeat timeout"
+	}
+	// 心跳正常但持续查询失败，同样视为不可用
+	if config.MaxQueryFails > 0 && s.FailCount >= config.MaxQueryFails {
+		return "query failures"
+	}
+	// 与心跳超时分开计算: 心跳一直正常，但太久没有成功响应查询
+	if config.QueryFailTimeout > 0 && !s.InlineInfo && s.FailCount > 0 {
+		since := s.LastQuerySuccess
+		if since.IsZero() {
+			since = s.FirstSeen
+		}
+		if time.Since(since) > config.QueryFailTimeout {
+			return "query fail timeout"
+		}
+	}
+	return ""
+}
+
+// cycleInfo 最近一轮清理和查询的情况，通过 /stats 的 cycle 字段输出
+type cycleInfo struct {
+	IntervalMs     int64     `json:"intervalMs"`
+	LastStart      time.Time `json:"lastStart"`      // 最近一轮开始的时间，尚未运行过时为零值
+	LastDurationMs int64     `json:"lastDurationMs"` // 从开始到本轮所有查询完成的耗时
+	Running        bool      `json:"running"`        // 本轮的查询是否仍在进行
+	Queried        int       `json:"queried"`        // 本轮加入查询队列的服务器数
+	Skipped        int       `json:"skipped"`        // 队列已满而跳过的服务器数
+	Deferred       int       `json:"deferred"`       // 没有玩家、按 -empty-query-every 留到以后几轮查询的服务器数
+	Removed        int       `json:"removed"`        // 本轮因超时或查询失败移除的服务器数
+	NextRun        time.Time `json:"nextRun"`        // 预计下一轮开始的时间
+}
+
+// cycleTracker 由 startCleanerAndQuery 和查询池更新，HTTP 处理函数读取
+type cycleTracker struct {
+	mu          sync.Mutex
+	info        cycleInfo
+	dispatching bool // 正在把本轮的服务器加入队列，此时队列变空不代表本轮结束
+}
+
+var queryCycle = &cycleTracker{}
+
+// schedule 记录查询间隔和第一轮的预计时间
+func (c *cycleTracker) schedule(interval time.Duration, next time.Time) {
+	c.mu.Lock()
+	c.info.IntervalMs = interval.Milliseconds()
+	c.info.NextRun = next
+	c.mu.Unlock()
+}
+
+// begin 标记新一轮开始
+func (c *cycleTracker) begin(now time.Time, interval time.Duration) {
+	c.mu.Lock()
+	c.info.LastStart = now
+	c.info.NextRun = now.Add(interval)
+	c.info.Running = true
+	c.dispatching = true
+	c.mu.Unlock()
+}
+
+// dispatched 记录本轮入队、推迟和移除的数量
+func (c *cycleTracker) dispatched(queried, skipped, deferred, removed int) {
+	c.mu.Lock()
+	c.info.Queried, c.info.Skipped, c.info.Deferred, c.info.Removed = queried, skipped, deferred, removed
+	c.dispatching = false
+	c.mu.Unlock()
+}
+
+// finish 在查询队列清空时调用，记录本轮耗时；重复调用时只有第一次生效
+func (c *cycleTracker) finish() {
+	c.mu.Lock()
+	if c.info.Running && !c.dispatching {
+		c.info.Running = false
+		c.info.LastDurationMs = time.Since(c.info.LastStart).Milliseconds()
+	}
+	c.mu.Unlock()
+}
+
+// snapshot 返回当前记录的副本
+func (c *cycleTracker) snapshot() cycleInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.info
+}
+
+// 查询队列长度，超出的服务器留到下一轮
+const queryQueueSize = 8192
+
+// queries 后台查询的 worker 池，在 main 中创建
+var queries *queryPool
+
+// queryPool 固定数量的 worker 从队列中取地址查询，限制同时打开的 UDP 连接数。
+// 同一 IP 同时进行的查询不超过 perIP 个，超出的地址排在该 IP 后面，
+// 由完成查询的 worker 接着处理，不占用其他 worker。
+type queryPool struct {
+	jobs    chan string
+	mu      sync.Mutex
+	pending map[string]bool            // 已入队但未查询完的地址，避免重复排队
+	waiters map[string][]chan struct{} // 等待地址查询完成的调用方，查询完成后关闭
+	hosts   map[string]*ipSlot         // 正在查询的 IP
+	perIP   int                        // 0 表示不限制
+	onIdle  func()                     // 所有已入队的地址都查询完时调用，在持有 mu 时执行
+	wg      sync.WaitGroup
+}
+
+// ipSlot 同一 IP 正在进行的查询数和排队等待的地址
+type ipSlot struct {
+	active  int
+	waiting []string
+}
+
+// newQueryPool 创建并启动 worker 池，ctx 取消后 worker 退出
+func newQueryPool(ctx context.Context, workers, perIP int, timeout time.Duration) *queryPool {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &queryPool{
+		jobs:    make(chan string, queryQueueSize),
+		pending: make(map[string]bool),
+		waiters: make(map[string][]chan struct{}),
+		hosts:   make(map[string]*ipSlot),
+		perIP:   perIP,
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.worker(ctx, timeout)
+	}
+	return p
+}
+
+// wait 等待所有 worker 退出
+func (p *queryPool) wait() {
+	p.wg.Wait()
+}
+
+// idle 报告队列中是否没有未查询完的地址
+func (p *queryPool) idle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pending) == 0
+}
+
+// enqueue 非阻塞地把地址加入队列，队列已满时返回 false；
+// 上一轮的查询尚未完成时不重复排队
+func (p *queryPool) enqueue(addr string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.pending[addr] {
+		return true
+	}
+	select {
+	case p.jobs <- addr:
+		p.pending[addr] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// enqueueWait 与 enqueue 相同，另外返回一个在该地址本次查询完成后关闭的 channel；
+// 地址已在队列中时等待已排队的那次查询。队列已满时返回 false
+func (p *queryPool) enqueueWait(addr string) (<-chan struct{}, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	done := make(chan struct{})
+	if !p.pending[addr] {
+		select {
+		case p.jobs <- addr:
+			p.pending[addr] = true
+		default:
+			return nil, false
+		}
+	}
+	p.waiters[addr] = append(p.waiters[addr], done)
+	return done, true
+}
+
+// worker 循环处理队列中的查询
+func (p *queryPool) worker(ctx context.Context, timeout time.Duration) {
+	defer p.wg.Done()
+	for {
+		var addr string
+		select {
+		case <-ctx.Done():
+			return
+		case addr = <-p.jobs:
+		}
+
+		ip := addressIP(addr)
+		if !p.acquire(ip, addr) {
+			continue
+		}
+		for addr != "" && ctx.Err() == nil {
+			// 服务器没有回复 A2S_INFO 时不再追加玩家和参数查询，避免死掉的服务器长时间占用 worker
+			if _, err := queryServerDetails(addr, timeout); err == nil {
+				updatePlayers(addr, timeout)
+				updateRules(addr, timeout)
+			}
+			addr = p.release(ip, addr)
+		}
+	}
+}
+
+// acquire 为 ip 占用一个查询名额；名额已满时把 addr 排到该 IP 后面并返回 false
+func (p *queryPool) acquire(ip, addr string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	slot := p.hosts[ip]
+	if slot == nil {
+		slot = &ipSlot{}
+		p.hosts[ip] = slot
+	}
+	if p.perIP > 0 && slot.active >= p.perIP {
+		slot.waiting = append(slot.waiting, addr)
+		return false
+	}
+	slot.active++
+	return true
+}
+
+// release 标记 addr 已查询完，并返回同一 IP 下一个等待的地址 (名额直接交给它)，没有则释放名额返回空串
+func (p *queryPool) release(ip, addr string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.pending, addr)
+	for _, done := range p.waiters[addr] {
+		close(done)
+	}
+	delete(p.waiters, addr)
+	if len(p.pending) == 0 && p.onIdle != nil {
+		p.onIdle()
+	}
+	slot := p.hosts[ip]
+	if len(slot.waiting) > 0 {
+		next := slot.waiting[0]
+		slot.waiting = slot.waiting[1:]
+		return next
+	}
+	slot.active--
+	if slot.active == 0 {
+		delete(p.hosts, ip)
+	}
+	return ""
+}
+
+// queryError 一次 A2S_INFO 查询失败的原因，reason 记录到 ServerInfo.LastError；
+// timedOut 为 true 时保留上次的数据，只标记为已过期
+type queryError struct {
+	reason   string
+	timedOut bool
+}
+
+func (e *queryError) Error() string { return e.reason }
+
+// a2sDialer 建立 A2S 连接，默认为 dialA2S；单独调用 queryServerInfo 时可以换成指向其他地址的连接
+type a2sDialer func(address string) (net.Conn, error)
+
+// queryServerInfo 向服务器发送一次 A2S_INFO (失败时按 -query-retries 重试) 并解析回复，
+// 不读取也不修改 manager，/api/verify 用它检查尚未注册的地址
+func queryServerInfo(dial a2sDialer, address string, timeout time.Duration) (*ServerInfo, error) {
+	resp, ping, err := fetchA2SInfo(dial, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// 解析到临时变量，数据有误时不改动已有的服务器信息
+	info, err := parseA2SInfo(resp)
+	if err != nil {
+		slog.Debug("A2S_INFO malformed response", "addr", address, "len", len(resp), "err", err)
+		reason := "parse error: " + err.Error()
+		if errors.Is(err, errA2SChallenge) {
+			// 带上 challenge 后仍然回复 challenge
+			reason = "challenge loop"
+		}
+		return nil, &queryError{reason: reason}
+	}
+	info.Address = address
+	info.Family = addressFamily(address)
+	info.Ping = ping
+	return &info, nil
+}
+
+// infoChallengeTTL A2S_INFO challenge 的缓存时长，需长于 -empty-query-every 按默认值放慢后的查询间隔
+const infoChallengeTTL = 2 * time.Minute
+
+// infoChallenges 按服务器地址缓存 A2S_INFO 的 challenge，在清理循环中删除过期的记录
+var infoChallenges = &challengeCache{entries: make(map[string]infoChallengeEntry)}
+
+// challengeCache 缓存服务器最近下发的 challenge，下一轮查询直接带上，省去一次往返。
+// challenge 失效时服务器会再次回复 0x41，按新的 challenge 重发即可。
+type challengeCache struct {
+	mu      sync.Mutex
+	entries map[string]infoChallengeEntry
+}
+
+// infoChallengeEntry 游戏服务器下发的 A2S_INFO challenge
+type infoChallengeEntry struct {
+	Value   []byte
+	Expires time.Time
+}
+
+// Get 返回未过期的 challenge，没有时返回 nil
+func (c *challengeCache) Get(address string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[address]; ok && time.Now().Before(e.Expires) {
+		return e.Value
+	}
+	return nil
+}
+
+func (c *challengeCache) Set(address string, challenge []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[address] = infoChallengeEntry{challenge, time.Now().Add(infoChallengeTTL)}
+}
+
+func (c *challengeCache) Forget(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, address)
+}
+
+// purge 删除过期的 challenge
+func (c *challengeCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for address, e := range c.entries {
+		if !now.Before(e.Expires) {
+			delete(c.entries, address)
+		}
+	}
+}
+
+// fetchA2SInfo 发送 A2S_INFO 并返回重组后的原始回复和往返延迟。
+// 2020 年后的服务器大多要求 challenge，因此按需要 challenge 的流程处理:
+// 有缓存的 challenge 时直接带上；否则先发不带 challenge 的请求，收到 0x41 后带上 challenge 重发并缓存。
+// 只有不要求 challenge 的服务器会对不带 challenge 的请求直接回复，此时不会多一次往返。
+func fetchA2SInfo(dial a2sDialer, address string, timeout time.Duration) ([]byte, time.Duration, error) {
+	conn, err := dial(address)
+	if err != nil {
+		slog.Debug("A2S_INFO dial failed", "addr", address, "err", err)
+		return nil, 0, &queryError{reason: "dial error: " + err.Error()}
+	}
+	defer conn.Close()
+
+	query := infoQuery
+	challenge := infoChallenges.Get(address)
+	if challenge != nil {
+		query = append(append([]byte{}, infoQuery...), challenge...)
+	}
+
+	// 单个 UDP 包丢失很常见，失败后稍等片刻重试
+	var resp []byte
+	var ping time.Duration
+	for attempt := 0; attempt <= config.QueryRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * queryRetryBackoff)
+		}
+		start := time.Now()
+		conn.Write(query)
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		if resp, err = readResponse(conn); err == nil {
+			ping = time.Since(start)
+			break
+		}
+	}
+	// 回复 0x41 + 4 字节 challenge 说明服务器要求 challenge 或缓存的已失效，
+	// 带上新的 challenge 重发一次；再收到 challenge 时按异常回复处理，不再循环
+	if err == nil && len(resp) >= 9 && resp[4] == 0x41 {
+		challenge = append([]byte(nil), resp[5:9]...)
+		conn.Write(append(append([]byte{}, infoQuery...), challenge...))
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		resp, err = readResponse(conn)
+	}
+	if err != nil {
+		infoChallenges.Forget(address)
+		slog.Debug("A2S_INFO query failed", "addr", address, "err", err)
+		reason := "read error: " + err.Error()
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			reason = "timeout"
+		}
+		return nil, 0, &queryError{reason: reason, timedOut: true}
+	}
+	if challenge != nil && len(resp) >= 5 && resp[4] != 0x41 {
+		infoChallenges.Set(address, challenge)
+	}
+	return resp, ping, nil
+}
+
+// queryServerDetails 返回的错误: 游戏不在 -allowed-games 中 (服务器随之移除)，或查询期间服务器已被移除
+var (
+	errGameNotAllowed = errors.New("game not allowed")
+	errServerGone     = errors.New("server not found")
+)
+
+// queryServerDetails 发送 A2S_INFO 查询并更新 manager 中的服务器，成功时返回更新后的副本。
+// 查询失败时记录失败原因，返回 *queryError。
+func queryServerDetails(address string, timeout time.Duration) (*ServerInfo, error) {
+	info, err := queryServerInfo(dialA2S, address, timeout)
+	if err != nil {
+		var qe *queryError
+		if errors.As(err, &qe) {
+			recordQueryFailure(address, qe.timedOut, qe.reason)
+		}
+		return nil, err
+	}
+
+	if !gameAllowed(info.GameDir) {
+		if _, ok := manager.Remove(address); ok {
+			slog.Info("Server dropped", "addr", address, "reason", "game not allowed", "gamedir", info.GameDir)
+			events.Publish(eventRemoved, address, info.Name)
+		}
+		return nil, errGameNotAllowed
+	}
+
+	// 查询期间服务器可能已被移除，只更新仍然存在的条目
+	var updated ServerInfo
+	ok := manager.Update(address, func(target *ServerInfo) {
+		now := time.Now()
+		target.applyInfo(info, now)
+		target.Ping = info.Ping
+		target.Stale = false
+		target.FailCount = 0
+		target.recordQuery(true)
+		target.LastQueryTime = now
+		target.LastQuerySuccess = now
+		target.LastError = ""
+		if !target.Listed {
+			target.Listed = true
+			slog.Info("Server verified", "addr", address)
+		}
+		events.Publish(eventUpdated, address, target.Name)
+		updated = *target
+	})
+	if !ok {
+		return nil, errServerGone
+	}
+	return &updated, nil
+}
+
+// defaultQueryPayload A2S_INFO 请求的标准负载
+const defaultQueryPayload = "Source Engine Query"
+
+// infoQuery A2S_INFO 请求: 0xFF 0xFF 0xFF 0xFF + 'T' + 负载 + 0x00，负载可用 -query-payload 修改
+var infoQuery, _ = buildInfoQuery(defaultQueryPayload)
+
+// buildInfoQuery 组装 A2S_INFO 请求，保证负载以唯一的 0x00 结尾
+func buildInfoQuery(payload string) ([]byte, error) {
+	payload = strings.TrimSuffix(payload, "\x00")
+	if strings.IndexByte(payload, 0x00) >= 0 {
+		return nil, errors.New("query payload must not contain NUL bytes")
+	}
+	query := append([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x54}, payload...)
+	return append(query, 0x00), nil
+}
+
+// queryRetryBackoff 重试间隔，第 n 次重试等待 n 倍
+const queryRetryBackoff = 200 * time.Millisecond
+
+// recordQueryFailure 记录一次查询失败及原因，timedOut 为 true 时同时标记数据已过期
+func recordQueryFailure(address string, timedOut bool, reason string) {
+	manager.Update(address, func(target *ServerInfo) {
+		target.FailCount++
+		target.recordQuery(false)
+		target.LastQueryTime = time.Now()
+		target.LastError = reason
+		if timedOut {
+			target.Stale = true
+		}
+	})
+}
+
+// maxPacketSize 单个回复包的最大长度，取 UDP 数据报长度字段的上限。
+// 部分 GoldSrc 服务器的单包回复超过 1400 字节，缓冲过小时会被静默截断导致解析失败。
+// 读取缓冲比它多一个字节，读满缓冲即说明回复超出了上限。
+const maxPacketSize = 65535
+
+// maxSplitSize Source 分片头中分包大小字段的上限，用于识别分片格式
+const maxSplitSize = 1400
+
+// errResponseTruncated 回复包超出读取缓冲被截断。UDP 套接字在缓冲足够大时不会截断，
+// HTTP 桥接和 SOCKS5 连接在收到的包放不进调用方的缓冲时同样返回该错误
+var errResponseTruncated = errors.New("response truncated")
+
+// splitFragment 分片包 (0xFFFFFFFE) 中的一片
+type splitFragment struct {
+	ID      uint32
+	Number  int
+	Total   int
+	Payload []byte
+
+	// Source 格式中 ID 最高位为 1 表示整个回复经过 bzip2 压缩，
+	// 第一片额外带有解压后的长度和 CRC32
+	Compressed bool
+	Size       uint32
+	CRC        uint32
+}
+
+// splitSet 同一请求 ID 下已收到的分片
+type splitSet struct {
+	parts    [][]byte
+	received int
+	bytes    int // 已收到的负载总长度
+
+	compressed bool
+	size       uint32
+	crc        uint32
+}
+
+// maxDecompressedSize 压缩回复解压后的长度上限，防止异常数据占用过多内存；
+// 未压缩的分片回复重组后同样受此限制
+const maxDecompressedSize = 1 << 20
+
+// packetBufferPool 复用 readResponse 的读取缓冲
+var packetBufferPool = sync.Pool{New: func() any { b := make([]byte, maxPacketSize+1); return &b }}
+
+// readResponse 读取一次完整的 A2S 回复，分片包会按编号重组。
+// 返回的数据以 0xFFFFFFFF 开头；读取超时后未集齐的分片直接丢弃。
+func readResponse(conn net.Conn) ([]byte, error) {
+	sets := make(map[uint32]*splitSet)
+	bp := packetBufferPool.Get().(*[]byte)
+	defer packetBufferPool.Put(bp)
+	buf := *bp
+	for {
+		n, err := conn.Read(buf)
+		// 截断的回复单独记录，以便与普通的解析失败区分
+		if errors.Is(err, errResponseTruncated) || err == nil && n == len(buf) {
+			slog.Warn("A2S response truncated", "addr", conn.RemoteAddr().String(), "size", n)
+			return nil, errResponseTruncated
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n < 4 {
+			continue
+		}
+
+		switch binary.LittleEndian.Uint32(buf[:4]) {
+		case 0xFFFFFFFF: // 单包回复
+			return append([]byte(nil), buf[:n]...), nil
+		case 0xFFFFFFFE: // 分片回复
+			frag, ok := parseSplitFragment(buf[:n])
+			if !ok {
+				continue
+			}
+			set, exists := sets[frag.ID]
+			if !exists {
+				set = &splitSet{parts: make([][]byte, frag.Total)}
+				sets[frag.ID] = set
+			}
+			if frag.Total != len(set.parts) || set.parts[frag.Number] != nil {
+				continue
+			}
+			set.parts[frag.Number] = frag.Payload
+			set.received++
+			set.bytes += len(frag.Payload)
+			if set.bytes > maxDecompressedSize {
+				slog.Warn("A2S split response too large", "addr", conn.RemoteAddr().String(), "size", set.bytes)
+				delete(sets, frag.ID)
+				continue
+			}
+			if frag.Number == 0 {
+				set.compressed, set.size, set.crc = frag.Compressed, frag.Size, frag.CRC
+			}
+			if set.received < len(set.parts) {
+				continue
+			}
+			data := bytes.Join(set.parts, nil)
+			if !set.compressed {
+				return data, nil
+			}
+			// 解压失败或校验不通过时丢弃这一组，继续等待直到超时
+			delete(sets, frag.ID)
+			if data, err = decompressSplit(data, set.size, set.crc); err != nil {
+				slog.Debug("Compressed split response dropped", "addr", conn.RemoteAddr().String(), "err", err)
+				continue
+			}
+			return data, nil
+		}
+	}
+}
+
+// parseSplitFragment 解析分片头，兼容两种格式:
+// Source:  FFFFFFFE <ID:4> <Total:1> <Number:1> <Size:2> <Payload>
+// GoldSrc: FFFFFFFE <ID:4> <Number 高 4 位 | Total 低 4 位> <Payload>
+func parseSplitFragment(pkt []byte) (splitFragment, bool) {
+	var frag splitFragment
+	if len(pkt) < 9 {
+		return frag, false
+	}
+	frag.ID = binary.LittleEndian.Uint32(pkt[4:8])
+
+	// Source 格式的 Size 字段是服务器的分包大小，通常为 1248，
+	// 借此与 GoldSrc 格式区分
+	if len(pkt) >= 12 {
+		total, number := int(pkt[8]), int(pkt[9])
+		size := int(binary.LittleEndian.Uint16(pkt[10:12]))
+		if total > 0 && number < total && size >= 500 && size <= maxSplitSize {
+			frag.Total, frag.Number = total, number
+			payload := pkt[12:]
+			frag.Compressed = frag.ID&0x80000000 != 0
+			if frag.Compressed && number == 0 {
+				if len(payload) < 8 {
+					return frag, false
+				}
+				frag.Size = binary.LittleEndian.Uint32(payload[0:4])
+				frag.CRC = binary.LittleEndian.Uint32(payload[4:8])
+				payload = payload[8:]
+			}
+			frag.Payload = append([]byte(nil), payload...)
+			return frag, true
+		}
+	}
+
+	frag.Total, frag.Number = int(pkt[8]&0x0F), int(pkt[8]>>4)
+	if frag.Total == 0 || frag.Number >= frag.Total {
+		return frag, false
+	}
+	frag.Payload = append([]byte(nil), pkt[9:]...)
+	return frag, true
+}
+
+// decompressSplit 解压 bzip2 压缩的分片回复，并检查长度和 CRC32
+func decompressSplit(data []byte, size, crc uint32) ([]byte, error) {
+	if size > maxDecompressedSize {
+		return nil, fmt.Errorf("decompressed size %d too large", size)
+	}
+	out, err := io.ReadAll(io.LimitReader(bzip2.NewReader(bytes.NewReader(data)), int64(size)+1))
+	if err != nil {
+		return nil, fmt.Errorf("bzip2: %w", err)
+	}
+	if uint32(len(out)) != size {
+		return nil, fmt.Errorf("decompressed size %d, expected %d", len(out), size)
+	}
+	if sum := crc32.ChecksumIEEE(out); sum != crc {
+		return nil, fmt.Errorf("CRC32 mismatch: got %08x, expected %08x", sum, crc)
+	}
+	return out, nil
+}
+
+// dialA2S 建立到游戏服务器的 A2S 连接，设置了 -query-bridge-url 时改为经由 HTTP 桥接，
+// 设置了 -socks5 时经由 SOCKS5 代理的 UDP 中继
+func dialA2S(address string) (net.Conn, error) {
+	if config.QueryBridge != "" {
+		return newBridgeConn(config.QueryBridge, address)
+	}
+	if config.SOCKS5 != "" {
+		return dialSOCKS5(config.SOCKS5, address)
+	}
+	return net.DialTimeout("udp", address, 3*time.Second)
+}
+
+// bridgeClient 访问 A2S HTTP 桥接的客户端，超时由每次读取的 deadline 控制
+var bridgeClient = &http.Client{}
+
+// bridgeConn 通过 HTTP 桥接转发 A2S 请求的 net.Conn 实现。
+// 每次 Write 的请求包在随后的 Read 中以 POST <bridge>?addr=<ip:port> 发出，
+// 请求体为原始 UDP 负载；桥接在 200 响应体中返回收到的回复包，每个包前加 2 字节大端长度，
+// 分片回复依次排列，504 视为游戏服务器未回复。
+type bridgeConn struct {
+	endpoint string
+	remote   bridgeAddr
+	pending  []byte
+	replies  [][]byte // 桥接已返回、尚未读取的回复包
+	deadline time.Time
+}
+
+// bridgeAddr 桥接连接的远端地址，即被查询的游戏服务器
+type bridgeAddr string
+
+func (a bridgeAddr) Network() string { return "a2s-bridge" }
+func (a bridgeAddr) String() string  { return string(a) }
+
+func newBridgeConn(bridge, address string) (*bridgeConn, error) {
+	u, err := url.Parse(bridge)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+	q.Set("addr", address)
+	u.RawQuery = q.Encode()
+	return &bridgeConn{endpoint: u.String(), remote: bridgeAddr(address)}, nil
+}
+
+func (c *bridgeConn) Write(b []byte) (int, error) {
+	c.pending = append([]byte(nil), b...)
+	return len(b), nil
+}
+
+// Read 每次返回一个回复包，读完后把下一个待发送的请求交给桥接；
+// 没有待发送的请求时等到 deadline 后超时，与 UDP 连接上没有更多数据时的行为一致
+func (c *bridgeConn) Read(b []byte) (int, error) {
+	if len(c.replies) > 0 {
+		pkt := c.replies[0]
+		c.replies = c.replies[1:]
+		if len(pkt) > len(b) {
+			return copy(b, pkt), errResponseTruncated
+		}
+		return copy(b, pkt), nil
+	}
+	ctx := context.Background()
+	if !c.deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, c.deadline)
+		defer cancel()
+	}
+	if c.pending == nil {
+		<-ctx.Done()
+		return 0, os.ErrDeadlineExceeded
+	}
+	payload := c.pending
+	c.pending = nil
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err := bridgeClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, fmt.Errorf("bridge: %w", err)
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGatewayTimeout:
+		return 0, os.ErrDeadlineExceeded
+	default:
+		return 0, fmt.Errorf("bridge: unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDecompressedSize))
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, os.ErrDeadlineExceeded
+		}
+		return 0, fmt.Errorf("bridge: %w", err)
+	}
+	for len(data) > 0 {
+		if len(data) < 2 || len(data)-2 < int(binary.BigEndian.Uint16(data)) {
+			return 0, errors.New("bridge: malformed reply framing")
+		}
+		n := int(binary.BigEndian.Uint16(data))
+		c.replies = append(c.replies, data[2:2+n])
+		data = data[2+n:]
+	}
+	if len(c.replies) == 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.Read(b)
+}
+
+func (c *bridgeConn) Close() error                       { return nil }
+func (c *bridgeConn) LocalAddr() net.Addr                { return bridgeAddr("") }
+func (c *bridgeConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *bridgeConn) SetDeadline(t time.Time) error      { c.deadline = t; return nil }
+func (c *bridgeConn) SetReadDeadline(t time.Time) error  { c.deadline = t; return nil }
+func (c *bridgeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// socks5HandshakeTimeout 与 SOCKS5 代理建立 UDP 关联的超时，与直接拨号的超时一致
+const socks5HandshakeTimeout = 3 * time.Second
+
+// parseSOCKS5 拆分 -socks5 的 [user:pass@]host:port，格式不对时 hostport 为空
+func parseSOCKS5(spec string) (user, pass, hostport string) {
+	if i := strings.LastIndexByte(spec, '@'); i >= 0 {
+		var ok bool
+		if user, pass, ok = strings.Cut(spec[:i], ":"); !ok || user == "" || len(user) > 255 || len(pass) > 255 {
+			return "", "", ""
+		}
+		spec = spec[i+1:]
+	}
+	if _, port, err := net.SplitHostPort(spec); err != nil || port == "" {
+		return "", "", ""
+	}
+	return user, pass, spec
+}
+
+// socks5Conn 经由 SOCKS5 UDP ASSOCIATE (RFC 1928) 转发 A2S 请求的 net.Conn 实现。
+// 每个连接单独建立一次关联，TCP 控制连接在 Close 前保持打开，代理据此维持 UDP 中继。
+type socks5Conn struct {
+	ctrl   net.Conn     // 到代理的 TCP 控制连接
+	relay  *net.UDPConn // 到代理 UDP 中继的套接字
+	dst    netip.AddrPort
+	header []byte // 请求包前的 SOCKS5 UDP 头，目标为被查询的服务器
+}
+
+// dialSOCKS5 与代理协商 (需要时使用用户名/密码认证) 并建立 UDP 关联
+func dialSOCKS5(proxy, address string) (net.Conn, error) {
+	dst, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return nil, err
+	}
+	dst = netip.AddrPortFrom(dst.Addr().Unmap(), dst.Port())
+	user, pass, hostport := parseSOCKS5(proxy)
+	ctrl, err := net.DialTimeout("tcp", hostport, socks5HandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: %w", err)
+	}
+	ctrl.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+	relayAddr, err := socks5Associate(ctrl, user, pass)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5: %w", err)
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// 代理回复的中继地址为 0.0.0.0 或 :: 时表示与控制连接相同的主机
+	if relayAddr.Addr().IsUnspecified() {
+		if tcp, ok := ctrl.RemoteAddr().(*net.TCPAddr); ok {
+			ip, _ := netip.AddrFromSlice(tcp.IP)
+			relayAddr = netip.AddrPortFrom(ip.Unmap(), relayAddr.Port())
+		}
+	}
+	relay, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(relayAddr))
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("socks5: %w", err)
+	}
+	return &socks5Conn{ctrl: ctrl, relay: relay, dst: dst, header: socks5UDPHeader(dst)}, nil
+}
+
+// socks5Associate 在控制连接上完成方法协商和 UDP ASSOCIATE 请求，返回代理的 UDP 中继地址
+func socks5Associate(ctrl net.Conn, user, pass string) (netip.AddrPort, error) {
+	var none netip.AddrPort
+	methods := []byte{0x05, 0x01, 0x00}
+	if user != "" {
+		methods = []byte{0x05, 0x01, 0x02}
+	}
+	if _, err := ctrl.Write(methods); err != nil {
+		return none, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return none, err
+	}
+	if reply[0] != 0x05 || reply[1] != methods[2] {
+		return none, fmt.Errorf("proxy rejected auth method 0x%02X", methods[2])
+	}
+	if user != "" {
+		auth := append([]byte{0x01, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(pass))), pass...)
+		if _, err := ctrl.Write(auth); err != nil {
+			return none, err
+		}
+		if _, err := io.ReadFull(ctrl, reply); err != nil {
+			return none, err
+		}
+		if reply[1] != 0x00 {
+			return none, errors.New("authentication failed")
+		}
+	}
+
+	// 客户端的 UDP 地址事先未知，按 RFC 1928 填 0.0.0.0:0
+	if _, err := ctrl.Write([]byte{0x05, 0x03, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return none, err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(ctrl, head); err != nil {
+		return none, err
+	}
+	if head[0] != 0x05 || head[1] != 0x00 {
+		return none, fmt.Errorf("UDP associate failed with reply 0x%02X", head[1])
+	}
+	var ipLen int
+	switch head[3] {
+	case 0x01:
+		ipLen = 4
+	case 0x04:
+		ipLen = 16
+	default:
+		return none, fmt.Errorf("unsupported relay address type 0x%02X", head[3])
+	}
+	rest := make([]byte, ipLen+2)
+	if _, err := io.ReadFull(ctrl, rest); err != nil {
+		return none, err
+	}
+	ip, _ := netip.AddrFromSlice(rest[:ipLen])
+	return netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(rest[ipLen:])), nil
+}
+
+// socks5UDPHeader 组装 UDP 请求头: RSV(2) FRAG(1) ATYP(1) DST.ADDR DST.PORT(2)
+func socks5UDPHeader(dst netip.AddrPort) []byte {
+	h := []byte{0, 0, 0, 0x01}
+	if dst.Addr().Is6() {
+		h[3] = 0x04
+	}
+	h = append(h, dst.Addr().AsSlice()...)
+	return binary.BigEndian.AppendUint16(h, dst.Port())
+}
+
+func (c *socks5Conn) Write(b []byte) (int, error) {
+	if _, err := c.relay.Write(append(c.header[:len(c.header):len(c.header)], b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read 去掉中继加上的 UDP 头后返回负载。分段 (FRAG 非 0) 的包和来自其他地址的包直接丢弃。
+// 中继包填满 b 时负载可能已被截断，返回 errResponseTruncated
+func (c *socks5Conn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.relay.Read(b)
+		if err != nil {
+			return 0, err
+		}
+		truncated := n == len(b)
+		if n < 4 || b[2] != 0 {
+			continue
+		}
+		var ipLen int
+		switch b[3] {
+		case 0x01:
+			ipLen = 4
+		case 0x04:
+			ipLen = 16
+		default:
+			continue
+		}
+		hdr := 4 + ipLen + 2
+		if n < hdr {
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(b[4 : 4+ipLen])
+		if netip.AddrPortFrom(ip.Unmap(), binary.BigEndian.Uint16(b[4+ipLen:hdr])) != c.dst {
+			continue
+		}
+		if truncated {
+			return copy(b, b[hdr:n]), errResponseTruncated
+		}
+		return copy(b, b[hdr:n]), nil
+	}
+}
+
+func (c *socks5Conn) Close() error {
+	c.relay.Close()
+	return c.ctrl.Close()
+}
+
+func (c *socks5Conn) LocalAddr() net.Addr                { return c.relay.LocalAddr() }
+func (c *socks5Conn) RemoteAddr() net.Addr               { return net.UDPAddrFromAddrPort(c.dst) }
+func (c *socks5Conn) SetDeadline(t time.Time) error      { return c.relay.SetDeadline(t) }
+func (c *socks5Conn) SetReadDeadline(t time.Time) error  { return c.relay.SetReadDeadline(t) }
+func (c *socks5Conn) SetWriteDeadline(t time.Time) error { return c.relay.SetWriteDeadline(t) }
+
+// challengeQuery 发送需要 challenge 的 A2S 请求 (A2S_PLAYER/A2S_RULES):
+// 先以 0xFFFFFFFF 作为 challenge 请求，服务器回复 0x41 <challenge> 后带上它重新请求。
+// 最多重发一次，避免服务器反复下发 challenge 时陷入循环。
+func challengeQuery(address string, timeout time.Duration, op byte) ([]byte, error) {
+	conn, err := dialA2S(address)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	challenge := []byte{0xFF, 0xFF, 0xFF, 0xFF}
+	for attempt := 0; attempt < 2; attempt++ {
+		req := append([]byte{0xFF, 0xFF, 0xFF, 0xFF, op}, challenge...)
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+
+		resp, err := readResponse(conn)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) >= 9 && resp[4] == 0x41 {
+			challenge = resp[5:9]
+			continue
+		}
+		return resp, nil
+	}
+	return nil, errors.New("challenge loop")
+}
+
+// queryServerPlayers 发送 A2S_PLAYER (0x55) 查询并解析 0x44 回复
+func queryServerPlayers(address string, timeout time.Duration) ([]Player, error) {
+	resp, err := challengeQuery(address, timeout, 0x55)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 6 || resp[4] != 0x44 {
+		return nil, errors.New("unexpected A2S_PLAYER response")
+	}
+	players, err := parsePlayers(newPacketReader(resp[5:]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed A2S_PLAYER response: %w", err)
+	}
+	return players, nil
+}
+
+// parsePlayers 解析玩家列表: Count, 每个玩家 Index, Name, Score(int32), Duration(float32)。
+// 部分服务器实际返回的玩家少于 Count，读完数据即停止。
+func parsePlayers(r *packetReader) ([]Player, error) {
+	count := int(r.Byte())
+	players := make([]Player, 0, count)
+	for i := 0; i < count && r.Len() > 0; i++ {
+		_ = r.Byte() // Index
+		var p Player
+		p.Name = r.CString()
+		p.Score = int32(r.Uint32())
+		p.Duration = r.Float32()
+		if r.Err() != nil {
+			return nil, r.Err()
+		}
+		players = append(players, p)
+	}
+	return players, r.Err()
+}
+
+// updatePlayers 为有玩家的服务器刷新玩家列表，查询失败时保留上次的结果
+func updatePlayers(address string, timeout time.Duration) {
+	s, ok := manager.Get(address)
+	if !ok {
+		return
+	}
+	populated := s.Players > 0
+
+	var players []Player
+	if populated {
+		var err error
+		if players, err = queryServerPlayers(address, timeout); err != nil {
+			slog.Debug("A2S_PLAYER query failed", "addr", address, "err", err)
+			return
+		}
+	}
+
+	manager.Update(address, func(target *ServerInfo) {
+		target.PlayerList = players
+		target.PlayersUpdated = time.Now()
+	})
+}
+
+// rulesRefreshInterval 服务器参数很少变化，超过该时间才重新查询
+const rulesRefreshInterval = 5 * time.Minute
+
+// queryServerRules 发送 A2S_RULES (0x56) 查询并解析 0x45 回复，
+// 该回复经常被拆成多个分片，由 readResponse 负责重组
+func queryServerRules(address string, timeout time.Duration) (map[string]string, error) {
+	resp, err := challengeQuery(address, timeout, 0x56)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 7 || resp[4] != 0x45 {
+		return nil, errors.New("unexpected A2S_RULES response")
+	}
+	rules, err := parseRules(newPacketReader(resp[5:]))
+	if err != nil {
+		return nil, fmt.Errorf("malformed A2S_RULES response: %w", err)
+	}
+	return rules, nil
+}
+
+// parseRules 解析参数列表: Count(int16), 每项 Name, Value。
+// 与玩家列表一样，实际条目少于 Count 时读完数据即停止。
+func parseRules(r *packetReader) (map[string]string, error) {
+	count := int(r.Uint16())
+	rules := make(map[string]string, count)
+	for i := 0; i < count && r.Len() > 0; i++ {
+		name := r.CString()
+		value := r.CString()
+		if r.Err() != nil {
+			return nil, r.Err()
+		}
+		rules[name] = value
+	}
+	return rules, r.Err()
+}
+
+// updateRules 定期刷新服务器参数，查询失败时保留上次的结果
+func updateRules(address string, timeout time.Duration) {
+	s, ok := manager.Get(address)
+	if !ok || time.Since(s.RulesUpdated) < rulesRefreshInterval {
+		return
+	}
+
+	rules, err := queryServerRules(address, timeout)
+	if err != nil {
+		// 很多服务器关闭了 A2S_RULES，记录查询时间，rulesRefreshInterval 之后再试
+		slog.Debug("A2S_RULES query failed", "addr", address, "err", err)
+		manager.Update(address, func(target *ServerInfo) {
+			target.RulesUpdated = time.Now()
+		})
+		return
+	}
+
+	manager.Update(address, func(target *ServerInfo) {
+		target.Rules = rules
+		target.RulesUpdated = time.Now()
+	})
+}
+
+// errTruncated 数据包在字段中途结束，或字符串缺少结尾的 0x00
+var errTruncated = errors.New("packet truncated")
+
+// packetReader 按小端序读取 A2S 回复，每次读取前检查剩余长度。
+// 第一次越界后记录错误，之后的读取都返回零值，调用方读完后检查 Err 即可。
+type packetReader struct {
+	buf []byte
+	err error
+}
+
+func newPacketReader(b []byte) *packetReader {
+	return &packetReader{buf: b}
+}
+
+// Len 剩余未读的字节数
+func (r *packetReader) Len() int {
+	return len(r.buf)
+}
+
+// Err 返回第一次越界读取的错误
+func (r *packetReader) Err() error {
+	return r.err
+}
+
+// next 取出 n 个字节，不足时记录 errTruncated 并返回 nil
+func (r *packetReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.buf) {
+		r.err = errTruncated
+		r.buf = nil
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+// Skip 跳过 n 个字节
+func (r *packetReader) Skip(n int) {
+	r.next(n)
+}
+
+// Byte 读取单个字节
+func (r *packetReader) Byte() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+// Uint16 读取小端序 uint16
+func (r *packetReader) Uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+// Uint32 读取小端序 uint32
+func (r *packetReader) Uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+// Uint64 读取小端序 uint64
+func (r *packetReader) Uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+// Float32 读取小端序 float32
+func (r *packetReader) Float32() float32 {
+	return math.Float32frombits(r.Uint32())
+}
+
+// CString 读取以 0x00 结尾的字符串，找不到结尾时记录 errTruncated
+func (r *packetReader) CString() string {
+	if r.err != nil {
+		return ""
+	}
+	i := bytes.IndexByte(r.buf, 0x00)
+	if i < 0 {
+		r.err = errTruncated
+		r.buf = nil
+		return ""
+	}
+	str := string(r.buf[:i])
+	r.buf = r.buf[i+1:]
+	return str
+}
+
+// ServerInfo.Engine 的取值
+const (
+	engineGoldSrc = "goldsrc"
+	engineSource  = "source"
+)
+
+// errA2SChallenge 回复是 0x41 challenge 而不是服务器信息
+var errA2SChallenge = errors.New("challenge response")
+
+// parseA2SInfo 解析一个完整的 A2S_INFO 回复 (以 FFFFFFFF 开头，分片已重组)，
+// 支持 Source 'I' 和旧版 GoldSrc 'm' 格式。不访问网络和全局状态，
+// 回复来自不可信的服务器，任何输入都只返回错误而不会 panic。
+func parseA2SInfo(data []byte) (ServerInfo, error) {
+	var info ServerInfo
+	if len(data) < 5 {
+		return info, errors.New("response too short")
+	}
+	r := newPacketReader(data[5:])
+	var err error
+	switch data[4] {
+	case 0x49: // 'I' Source 格式，GoldSrc 新版本也使用
+		err = parseSourceInfo(r, &info)
+		info.Engine = engineSource
+		// Steam 版 HLDS 也以 'I' 回复，但网络协议仍是 GoldSrc 的 47/48
+		if info.Protocol == 47 || info.Protocol == 48 {
+			info.Engine = engineGoldSrc
+		}
+	case 0x6D: // 'm' 旧版 GoldSrc 格式
+		err = parseGoldSrcInfo(r, &info)
+		info.Engine = engineGoldSrc
+	case 0x41:
+		err = errA2SChallenge
+	default:
+		err = fmt.Errorf("unexpected header 0x%02X", data[4])
+	}
+	return info, err
+}
+
+// parseSourceInfo 解析 Source 格式:
+// Protocol, Name, Map, Folder, Game, ID, Players, MaxPlayers, Bots, Type, OS, Visibility, VAC,
+// Version, EDF 及其标记的可选字段
+func parseSourceInfo(r *packetReader, info *ServerInfo) error {
+	info.Protocol = int(r.Byte())
+	info.Name = r.CString()
+	info.Map = r.CString()
+	info.GameDir = r.CString()
+	info.GameDesc = r.CString()
+	info.GameID = int(r.Uint16()) // 只有 16 位，EDF 中的 64 位 GameID 会覆盖它
+	info.Players = int(r.Byte())
+	info.MaxPlayers = int(r.Byte())
+	info.Bots = int(r.Byte())
+	info.Dedicated = r.Byte() == 'd' // Server type: d/l/p
+	info.OS = osName(r.Byte())
+	info.Passworded = r.Byte() == 1
+	info.Secure = r.Byte() == 1
+	if info.GameID == 2400 { // The Ship: Mode, Witnesses, Duration
+		r.Skip(3)
+	}
+	info.Version = r.CString()
+
+	// EDF (Extra Data Flag)，旧服务器没有这部分
+	if r.Err() != nil || r.Len() == 0 {
+		return r.Err()
+	}
+	edf := r.Byte()
+	if edf&0x80 != 0 { // 游戏端口
+		info.GamePort = int(r.Uint16())
+	}
+	if edf&0x10 != 0 { // SteamID
+		r.Skip(8)
+	}
+	if edf&0x40 != 0 { // SourceTV 端口和名称
+		r.Skip(2)
+		_ = r.CString()
+	}
+	if edf&0x20 != 0 { // 关键字 (sv_tags)
+		info.Keywords = splitKeywords(r.CString())
+	}
+	if edf&0x01 != 0 { // 64 位 GameID，低 24 位是完整的 App ID，超过 65535 的游戏以此为准
+		if id := int(r.Uint64() & 0xFFFFFF); id != 0 {
+			info.GameID = id
+		}
+	}
+	return r.Err()
+}
+
+// splitKeywords 拆分以逗号分隔的关键字
+func splitKeywords(s string) []string {
+	var keywords []string
+	for _, k := range strings.Split(s, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keywords = append(keywords, k)
+		}
+	}
+	return keywords
+}
+
+// parseGoldSrcInfo 解析旧版 GoldSrc 格式:
+// Address, Name, Map, Folder, Game, Players, MaxPlayers, Protocol, Type, OS, Visibility, Mod, [Mod 信息], VAC, Bots
+func parseGoldSrcInfo(r *packetReader, info *ServerInfo) error {
+	_ = r.CString() // Address
+	info.Name = r.CString()
+	info.Map = r.CString()
+	info.GameDir = r.CString()
+	info.GameDesc = r.CString()
+	info.Players = int(r.Byte())
+	info.MaxPlayers = int(r.Byte())
+	info.Protocol = int(r.Byte())
+	info.Dedicated = r.Byte() == 'D' // Server type: D/L/P
+	info.OS = osName(r.Byte())
+	info.Passworded = r.Byte() == 1
+	if r.Byte() == 1 { // Mod
+		_ = r.CString() // Link
+		_ = r.CString() // Download link
+		r.Skip(1)       // NULL
+		r.Skip(4)       // Version
+		r.Skip(4)       // Size
+		r.Skip(1)       // Type
+		r.Skip(1)       // DLL
+	}
+	info.Secure = r.Byte() == 1
+	info.Bots = int(r.Byte())
+	return r.Err()
+}
+
+// osName 将环境字节转换为操作系统名称
+func osName(env byte) string {
+	switch env {
+	case 'l', 'L':
+		return "Linux"
+	case 'w', 'W':
+		return "Windows"
+	case 'm', 'o':
+		return "Mac"
+	}
+	return ""
 }
@@ -0,0 +1,638 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 抓包得到的 A2S_INFO 回复，地址和名称已替换
+
+// steamHLDSReply Steam 版 HLDS (CS 1.6) 的 'I' 回复: 协议 48，EDF 带端口、SteamID、关键字和 64 位 GameID
+const steamHLDSReply = "\xFF\xFF\xFF\xFF\x49\x30" +
+	"Dust2 Only | 24/7\x00de_dust2\x00cstrike\x00Counter-Strike\x00" +
+	"\x0A\x00\x0C\x20\x02dl\x00\x01" +
+	"1.1.2.7/Stdio\x00" +
+	"\xB1\x87\x69" +
+	"\x01\x02\x03\x04\x05\x06\x07\x08" +
+	"alltalk,respawn\x00" +
+	"\x0A\x00\x00\x00\x00\x00\x00\x00"
+
+// sourceReply Source 引擎 (CS:S) 的 'I' 回复，没有 EDF
+const sourceReply = "\xFF\xFF\xFF\xFF\x49\x11" +
+	"Source Server\x00de_nuke\x00cstrike\x00Counter-Strike: Source\x00" +
+	"\xF0\x00\x03\x18\x00dw\x01\x00" +
+	"7600546\x00"
+
+// goldSrcReply 旧版 GoldSrc 的 'm' 回复，不带 Mod 信息
+const goldSrcReply = "\xFF\xFF\xFF\xFF\x6D" +
+	"1.2.3.4:27015\x00Old Server\x00cs_assault\x00cstrike\x00Counter-Strike\x00" +
+	"\x05\x10\x2FDL\x00\x00\x01\x03"
+
+// goldSrcModReply 运行 Mod 的旧版 GoldSrc 回复，Mod 信息之后才是 VAC 和机器人数
+const goldSrcModReply = "\xFF\xFF\xFF\xFF\x6D" +
+	"1.2.3.4:27016\x00Mod Server\x00ns_veil\x00ns\x00Natural Selection\x00" +
+	"\x08\x20\x2FDW\x01\x01" +
+	"http://example.com\x00http://example.com/dl\x00\x00" +
+	"\x01\x00\x00\x00\x00\x00\x10\x00\x00\x01" +
+	"\x00\x00"
+
+func TestParseA2SInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr error // 为 nil 时要求解析成功
+		want    ServerInfo
+	}{
+		{
+			name: "steam hlds",
+			data: steamHLDSReply,
+			want: ServerInfo{
+				Name: "Dust2 Only | 24/7", Map: "de_dust2", GameDir: "cstrike", GameDesc: "Counter-Strike",
+				Players: 12, MaxPlayers: 32, Bots: 2, OS: "Linux", Dedicated: true, Secure: true,
+				Version: "1.1.2.7/Stdio", Protocol: 48, Engine: engineGoldSrc, GameID: 10, GamePort: 27015,
+				Keywords: []string{"alltalk", "respawn"},
+			},
+		},
+		{
+			name: "source",
+			data: sourceReply,
+			want: ServerInfo{
+				Name: "Source Server", Map: "de_nuke", GameDir: "cstrike", GameDesc: "Counter-Strike: Source",
+				Players: 3, MaxPlayers: 24, OS: "Windows", Dedicated: true, Passworded: true,
+				Version: "7600546", Protocol: 17, Engine: engineSource, GameID: 240,
+			},
+		},
+		{
+			name: "goldsrc 0x6D",
+			data: goldSrcReply,
+			want: ServerInfo{
+				Name: "Old Server", Map: "cs_assault", GameDir: "cstrike", GameDesc: "Counter-Strike",
+				Players: 5, MaxPlayers: 16, Bots: 3, OS: "Linux", Dedicated: true, Secure: true,
+				Protocol: 47, Engine: engineGoldSrc,
+			},
+		},
+		{
+			name: "goldsrc 0x6D with mod",
+			data: goldSrcModReply,
+			want: ServerInfo{
+				Name: "Mod Server", Map: "ns_veil", GameDir: "ns", GameDesc: "Natural Selection",
+				Players: 8, MaxPlayers: 32, OS: "Windows", Dedicated: true, Passworded: true,
+				Protocol: 47, Engine: engineGoldSrc,
+			},
+		},
+		{
+			// 人数字段只有一个字节，超出 MaxPlayers 的值原样保留，不会溢出或出错
+			name: "oversized player and bot counts",
+			data: "\xFF\xFF\xFF\xFF\x49\x30n\x00m\x00d\x00g\x00\x0A\x00\xFF\x20\xFFdl\x00\x01v\x00",
+			want: ServerInfo{
+				Name: "n", Map: "m", GameDir: "d", GameDesc: "g", Players: 255, MaxPlayers: 32, Bots: 255,
+				OS: "Linux", Dedicated: true, Secure: true, Version: "v", Protocol: 48, Engine: engineGoldSrc, GameID: 10,
+			},
+		},
+		{name: "challenge", data: "\xFF\xFF\xFF\xFF\x41\x01\x02\x03\x04", wantErr: errA2SChallenge},
+		{name: "too short", data: "\xFF\xFF\xFF", wantErr: errors.New("response too short")},
+		{name: "unknown header", data: "\xFF\xFF\xFF\xFF\x44\x00", wantErr: errors.New("unexpected header 0x44")},
+		{name: "source truncated in string", data: steamHLDSReply[:12], wantErr: errTruncated},
+		{name: "source truncated in counts", data: sourceReply[:len(sourceReply)-17], wantErr: errTruncated},
+		{name: "source missing NUL in version", data: sourceReply[:len(sourceReply)-1], wantErr: errTruncated},
+		{name: "source truncated in EDF", data: steamHLDSReply[:len(steamHLDSReply)-4], wantErr: errTruncated},
+		{name: "goldsrc truncated in string", data: goldSrcReply[:20], wantErr: errTruncated},
+		{name: "goldsrc missing bots", data: goldSrcReply[:len(goldSrcReply)-1], wantErr: errTruncated},
+		{name: "goldsrc mod missing NUL in link", data: goldSrcModReply[:90], wantErr: errTruncated},
+		{name: "header only", data: "\xFF\xFF\xFF\xFF\x49", wantErr: errTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseA2SInfo([]byte(tt.data))
+			if tt.wantErr != nil {
+				if err == nil {
+					t.Fatalf("parseA2SInfo() error = nil, want %v", tt.wantErr)
+				}
+				if !errors.Is(err, tt.wantErr) && err.Error() != tt.wantErr.Error() {
+					t.Fatalf("parseA2SInfo() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseA2SInfo() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseA2SInfo() =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSourceInfoWithoutEDF(t *testing.T) {
+	var info ServerInfo
+	// 去掉 0xFFFFFFFF 'I'，直接从协议字节开始
+	if err := parseSourceInfo(newPacketReader([]byte(sourceReply[5:])), &info); err != nil {
+		t.Fatalf("parseSourceInfo() error = %v", err)
+	}
+	if info.GamePort != 0 || info.Keywords != nil {
+		t.Errorf("parseSourceInfo() without EDF: port %d, keywords %v", info.GamePort, info.Keywords)
+	}
+}
+
+func TestParseGoldSrcInfoSkipsModFields(t *testing.T) {
+	var info ServerInfo
+	if err := parseGoldSrcInfo(newPacketReader([]byte(goldSrcModReply[5:])), &info); err != nil {
+		t.Fatalf("parseGoldSrcInfo() error = %v", err)
+	}
+	if info.Secure || info.Bots != 0 || info.Name != "Mod Server" {
+		t.Errorf("parseGoldSrcInfo() = %+v", info)
+	}
+}
+
+// FuzzParseA2SInfo 任意输入都不能让解析器 panic 或卡住
+func FuzzParseA2SInfo(f *testing.F) {
+	for _, seed := range []string{
+		steamHLDSReply, sourceReply, goldSrcReply, goldSrcModReply,
+		steamHLDSReply[:40], goldSrcModReply[:90],
+		"\xFF\xFF\xFF\xFF\x41\x01\x02\x03\x04", "\xFF\xFF\xFF\xFF\x49", "",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		info, err := parseA2SInfo(data)
+		if err == nil && len(data) < 5 {
+			t.Fatalf("parseA2SInfo(%x) accepted a packet without a header: %+v", data, info)
+		}
+	})
+}
+
+// fakeA2SServer 在 127.0.0.1 上启动假的游戏服务器，reply 根据收到的请求返回要依次发送的包；
+// 返回的 a2sDialer 不论目标地址都连到这个服务器
+func fakeA2SServer(t *testing.T, reply func(req []byte) [][]byte) a2sDialer {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			for _, pkt := range reply(append([]byte(nil), buf[:n]...)) {
+				conn.WriteToUDP(pkt, from)
+			}
+		}
+	}()
+	addr := conn.LocalAddr().String()
+	return func(string) (net.Conn, error) { return net.Dial("udp", addr) }
+}
+
+// sourceSplit 把回复按 Source 分片格式切成两片，先发第二片
+func sourceSplit(reply string, id uint32) [][]byte {
+	frag := func(number int, payload string) []byte {
+		b := binary.LittleEndian.AppendUint32([]byte{0xFE, 0xFF, 0xFF, 0xFF}, id)
+		b = append(b, 2, byte(number))
+		b = binary.LittleEndian.AppendUint16(b, 1248)
+		return append(b, payload...)
+	}
+	mid := len(reply) / 2
+	return [][]byte{frag(1, reply[mid:]), frag(0, reply[:mid])}
+}
+
+// goldSrcSplit 把回复按 GoldSrc 分片格式 (编号在高 4 位，总数在低 4 位) 切成两片，先发第二片
+func goldSrcSplit(reply string, id uint32) [][]byte {
+	frag := func(number int, payload string) []byte {
+		b := binary.LittleEndian.AppendUint32([]byte{0xFE, 0xFF, 0xFF, 0xFF}, id)
+		b = append(b, byte(number<<4|2))
+		return append(b, payload...)
+	}
+	mid := len(reply) / 2
+	return [][]byte{frag(1, reply[mid:]), frag(0, reply[:mid])}
+}
+
+func TestQueryServerInfoChallenge(t *testing.T) {
+	const address = "192.0.2.10:27015"
+	t.Cleanup(func() { infoChallenges.Forget(address) })
+
+	challenge := []byte{0x11, 0x22, 0x33, 0x44}
+	var requests atomic.Int32
+	dial := fakeA2SServer(t, func(req []byte) [][]byte {
+		requests.Add(1)
+		if !bytes.HasPrefix(req, infoQuery) {
+			t.Errorf("unexpected request %x", req)
+			return nil
+		}
+		if !bytes.Equal(req[len(infoQuery):], challenge) {
+			return [][]byte{append([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0x41}, challenge...)}
+		}
+		return [][]byte{[]byte(steamHLDSReply)}
+	})
+
+	info, err := queryServerInfo(dial, address, time.Second)
+	if err != nil {
+		t.Fatalf("queryServerInfo() error = %v", err)
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("first query sent %d requests, want 2 (plain, then with challenge)", n)
+	}
+	want := ServerInfo{
+		Address: address, Family: "ipv4",
+		Name: "Dust2 Only | 24/7", Map: "de_dust2", GameDir: "cstrike", GameDesc: "Counter-Strike",
+		Players: 12, MaxPlayers: 32, Bots: 2, OS: "Linux", Dedicated: true, Secure: true,
+		Version: "1.1.2.7/Stdio", Protocol: 48, Engine: engineGoldSrc, GameID: 10, GamePort: 27015,
+		Keywords: []string{"alltalk", "respawn"},
+	}
+	if info.Ping <= 0 {
+		t.Errorf("Ping = %v, want > 0", info.Ping)
+	}
+	got := *info
+	got.Ping = 0
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queryServerInfo() =\n%+v\nwant\n%+v", got, want)
+	}
+
+	// 第二次查询直接带上缓存的 challenge
+	requests.Store(0)
+	if _, err := queryServerInfo(dial, address, time.Second); err != nil {
+		t.Fatalf("second queryServerInfo() error = %v", err)
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("second query sent %d requests, want 1 (cached challenge)", n)
+	}
+}
+
+func TestQueryServerInfoSplit(t *testing.T) {
+	tests := []struct {
+		name  string
+		split func(reply string, id uint32) [][]byte
+	}{
+		{"source", sourceSplit},
+		{"goldsrc", goldSrcSplit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dial := fakeA2SServer(t, func(req []byte) [][]byte {
+				return tt.split(sourceReply, 7)
+			})
+			info, err := queryServerInfo(dial, "192.0.2.11:27015", time.Second)
+			if err != nil {
+				t.Fatalf("queryServerInfo() error = %v", err)
+			}
+			if info.Name != "Source Server" || info.Map != "de_nuke" || info.GameID != 240 ||
+				info.Players != 3 || info.MaxPlayers != 24 || info.Version != "7600546" || info.Engine != engineSource {
+				t.Errorf("queryServerInfo() = %+v", info)
+			}
+		})
+	}
+}
+
+func TestQueryServerInfoTimeout(t *testing.T) {
+	dial := fakeA2SServer(t, func(req []byte) [][]byte { return nil })
+	_, err := queryServerInfo(dial, "192.0.2.12:27015", 100*time.Millisecond)
+	var qe *queryError
+	if !errors.As(err, &qe) || !qe.timedOut || qe.reason != "timeout" {
+		t.Fatalf("queryServerInfo() error = %#v, want timeout queryError", err)
+	}
+}
+
+func TestReadResponseTruncated(t *testing.T) {
+	packet := func(size int) []byte {
+		b := make([]byte, size)
+		copy(b, "\xFF\xFF\xFF\xFF\x49")
+		return b
+	}
+	tests := []struct {
+		name    string
+		size    int
+		wantErr error
+	}{
+		{"largest datagram", maxPacketSize, nil},
+		{"fills read buffer", maxPacketSize + 1, errResponseTruncated},
+		{"larger than read buffer", maxPacketSize + 100, errResponseTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &bridgeConn{remote: "192.0.2.13:27015", replies: [][]byte{packet(tt.size)}}
+			data, err := readResponse(conn)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readResponse() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && len(data) != tt.size {
+				t.Errorf("readResponse() returned %d bytes, want %d", len(data), tt.size)
+			}
+		})
+	}
+
+	// 放不进调用方缓冲的桥接回复包不能被静默截断
+	conn := &bridgeConn{remote: "192.0.2.13:27015", replies: [][]byte{packet(64)}}
+	if n, err := conn.Read(make([]byte, 32)); n != 32 || !errors.Is(err, errResponseTruncated) {
+		t.Errorf("bridgeConn.Read() = %d, %v, want 32, %v", n, err, errResponseTruncated)
+	}
+}
+
+func TestServerInfoJSONFieldNames(t *testing.T) {
+	s := ServerInfo{Address: "192.0.2.14:27015", Name: "n", MaxPlayers: 32, GameID: 10, CountryCode: "CN"}
+	data, err := s.marshalJSON("unix", "snake")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("snake output is not valid JSON: %v\n%s", err, data)
+	}
+	for key, want := range map[string]any{
+		"address": "192.0.2.14:27015", "max_players": 32.0, "game_id": 10.0, "country_code": "CN",
+		"first_seen": 0.0, "last_heartbeat_interval": 0.0, "unresponsive": false,
+	} {
+		if got[key] != want {
+			t.Errorf("%s = %v, want %v", key, got[key], want)
+		}
+	}
+	if _, ok := got["maxPlayers"]; ok {
+		t.Errorf("snake output still has camelCase key maxPlayers: %s", data)
+	}
+
+	// /events 给内置页面使用，始终是 camelCase 和 RFC 3339
+	data, err = json.Marshal(eventServer{&s})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"maxPlayers":32`)) || !bytes.Contains(data, []byte(`"firstSeen":"0001-01-01T00:00:00Z"`)) {
+		t.Errorf("eventServer JSON = %s", data)
+	}
+}
+
+func TestGeoDBDecode(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		want     any
+		wantNext int
+		wantErr  string // 非空时要求返回该错误
+	}{
+		{name: "string", data: "\x42hi", want: "hi", wantNext: 3},
+		{name: "uint16", data: "\xA1\x2A", want: uint64(42), wantNext: 2},
+		{name: "uint32", data: "\xC2\x01\x00", want: uint64(256), wantNext: 3},
+		{
+			// map{"a": uint16 42, "b": 指向偏移 10 的 "hi"}
+			name:     "map with pointer",
+			data:     "\x02\x00" + "\x41a\xA1\x2A" + "\x41b\x20\x0A" + "\x42hi",
+			want:     map[string]any{"a": uint64(42), "b": "hi"},
+			wantNext: 10,
+		},
+		{name: "pointer", data: "\x20\x02\x42hi", want: "hi", wantNext: 2},
+		{name: "pointer to itself", data: "\x20\x00", wantErr: "data nested too deeply"},
+		{name: "map containing pointer to itself", data: "\x01\x00\x41a\x20\x00", wantErr: "data nested too deeply"},
+		{name: "pointer out of range", data: "\x20\x10", wantErr: "offset out of range"},
+		{name: "truncated string", data: "\x45hi", wantErr: "value out of range"},
+		{name: "truncated map", data: "\x02\x00\x41a\xA1\x2A", wantErr: "offset out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := &geoDB{data: []byte(tt.data)}
+			got, next, err := db.decode(0, 0)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("decode() = %v, %v, want error %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decode() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) || next != tt.wantNext {
+				t.Errorf("decode() = %#v, %d, want %#v, %d", got, next, tt.want, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestMasterOrderCacheBounded(t *testing.T) {
+	c := masterOrderCache{entries: make(map[string]masterOrder)}
+	list := make([]netip.AddrPort, maxMasterOrderAddrs/4)
+	for i := 0; i < 10; i++ {
+		c.store(netip.AddrPortFrom(netip.AddrFrom4([4]byte{198, 51, 100, byte(i)}), 27005).String(), list)
+	}
+	if c.addrs > maxMasterOrderAddrs || len(c.entries) != 4 {
+		t.Fatalf("cache holds %d entries with %d addresses, want 4 entries within %d", len(c.entries), c.addrs, maxMasterOrderAddrs)
+	}
+	if c.load("198.51.100.0:27005") != nil {
+		t.Error("oldest order was not evicted")
+	}
+	if c.load("198.51.100.9:27005") == nil {
+		t.Error("newest order was evicted")
+	}
+
+	// 同一客户端重新保存时替换旧条目，不重复计数
+	c.store("198.51.100.9:27005", list[:10])
+	if want := 3*len(list) + 10; c.addrs != want {
+		t.Errorf("addrs = %d after replacing an entry, want %d", c.addrs, want)
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	base := ServerInfo{
+		Address: "192.0.2.20:27015", Name: "Dust2 Only", Map: "de_dust2", GameDir: "cstrike", GameID: 10,
+		Players: 5, MaxPlayers: 32, OS: "Linux", Dedicated: true, Secure: true, Keywords: []string{"alltalk"},
+	}
+	empty, full, locked := base, base, base
+	empty.Players = 0
+	full.Players = 32
+	locked.Passworded = true
+
+	tests := []struct {
+		name   string
+		server ServerInfo
+		filter string
+		want   bool
+	}{
+		{name: "no filter", server: base, filter: "", want: true},
+		{name: "gamedir and map", server: base, filter: `\gamedir\cstrike\map\de_dust2`, want: true},
+		{name: "other map", server: base, filter: `\map\de_nuke`, want: false},
+		{name: "key case", server: base, filter: `\MAP\DE_DUST2`, want: true},
+		{name: "key without value", server: base, filter: `\map`, want: true},
+		{name: "unknown key", server: base, filter: `\foo\bar`, want: true},
+		{name: "unknown key then mismatch", server: base, filter: `\foo\bar\map\de_nuke`, want: false},
+		{name: "empty on populated", server: base, filter: `\empty\1`, want: true},
+		{name: "empty on empty", server: empty, filter: `\empty\1`, want: false},
+		{name: "empty off", server: empty, filter: `\empty\0`, want: true},
+		{name: "full on full", server: full, filter: `\full\1`, want: false},
+		{name: "full on free slots", server: base, filter: `\full\1`, want: true},
+		{name: "password 0 on open", server: base, filter: `\password\0`, want: true},
+		{name: "password 0 on passworded", server: locked, filter: `\password\0`, want: false},
+		{name: "password 1 on passworded", server: locked, filter: `\password\1`, want: true},
+		{name: "nor matching", server: base, filter: `\nor\1\map\de_dust2`, want: false},
+		{name: "nor none matching", server: base, filter: `\nor\2\map\de_nuke\gamedir\valve`, want: true},
+		{name: "nand all matching", server: base, filter: `\nand\2\map\de_dust2\gamedir\cstrike`, want: false},
+		{name: "nand partly matching", server: base, filter: `\nand\2\map\de_dust2\gamedir\valve`, want: true},
+		{name: "nand inside nor", server: base, filter: `\nor\1\nand\2\map\de_dust2\gamedir\cstrike`, want: true},
+		{name: "nor inside nand", server: base, filter: `\nand\2\nor\1\map\de_nuke\secure\1`, want: false},
+		// 内层 nor 整体算作外层的一个条件，之后的 \map\de_dust2 回到顶层
+		{name: "nested nor consumes one term", server: base, filter: `\nor\1\nor\1\map\de_nuke\map\de_dust2`, want: false},
+		{name: "nested nor then top-level mismatch", server: base, filter: `\nor\1\nor\1\map\de_dust2\map\de_nuke`, want: false},
+		{name: "nor count beyond terms", server: base, filter: `\nor\5\map\de_nuke`, want: true},
+		{name: "nand count beyond terms", server: base, filter: `\nand\5\map\de_dust2`, want: false},
+		{name: "nor with bad count", server: base, filter: `\nor\x\map\de_nuke`, want: false},
+		{name: "nor with negative count", server: base, filter: `\nor\-1\map\de_dust2`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.server
+			if got := matchFilter(&s, tt.filter); got != tt.want {
+				t.Errorf("matchFilter(%q) = %v, want %v", tt.filter, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMasterQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    masterQuery
+		wantOK  bool
+	}{
+		{
+			name:    "region byte",
+			payload: "1\x030.0.0.0:0\x00\\gamedir\\cstrike\x00",
+			want:    masterQuery{Region: 0x03, Seed: "0.0.0.0:0", Filter: `\gamedir\cstrike`},
+			wantOK:  true,
+		},
+		{
+			name:    "all regions",
+			payload: "1\xFF10.0.0.1:27015\x00\x00",
+			want:    masterQuery{Region: regionAll, Seed: "10.0.0.1:27015"},
+			wantOK:  true,
+		},
+		{
+			// 不带区域字节的旧客户端直接从 seed 开始，首字节是数字
+			name:    "no region byte",
+			payload: "10.0.0.0:0\x00\\map\\de_dust2\x00",
+			want:    masterQuery{Region: regionAll, Seed: "0.0.0.0:0", Filter: `\map\de_dust2`},
+			wantOK:  true,
+		},
+		{
+			name:    "filter without trailing NUL",
+			payload: "1\xFF0.0.0.0:0\x00\\secure\\1",
+			want:    masterQuery{Region: regionAll, Seed: "0.0.0.0:0", Filter: `\secure\1`},
+			wantOK:  true,
+		},
+		{
+			name:    "no filter",
+			payload: "1\xFF0.0.0.0:0\x00",
+			want:    masterQuery{Region: regionAll, Seed: "0.0.0.0:0"},
+			wantOK:  true,
+		},
+		{
+			name:    "legacy",
+			payload: "c\\gamedir\\cstrike\x00\n",
+			want:    masterQuery{Region: regionAll, Filter: `\gamedir\cstrike`, Legacy: true},
+			wantOK:  true,
+		},
+		{name: "legacy without filter", payload: "c", want: masterQuery{Region: regionAll, Legacy: true}, wantOK: true},
+		{name: "empty", payload: "", wantOK: false},
+		{name: "opcode only", payload: "1", wantOK: false},
+		{name: "too short", payload: "1\xFF", wantOK: false},
+		{name: "seed without NUL", payload: "1\xFF0.0.0.0:0", wantOK: false},
+		{name: "other opcode", payload: "q\xFF0.0.0.0:0\x00", wantOK: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := parseMasterQuery([]byte(tt.payload))
+			if ok != tt.wantOK {
+				t.Fatalf("parseMasterQuery(%q) ok = %v, want %v", tt.payload, ok, tt.wantOK)
+			}
+			if ok && got != tt.want {
+				t.Errorf("parseMasterQuery(%q) = %+v, want %+v", tt.payload, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestMasterQueryPaging 按 seed 分批拉取完整列表，检查回复格式、包大小和 0.0.0.0:0 结束标记
+func TestMasterQueryPaging(t *testing.T) {
+	oldOrder := config.ListOrder
+	config.ListOrder = "address"
+	t.Cleanup(func() {
+		config.ListOrder = oldOrder
+		manager.RemoveFunc(func(*ServerInfo) bool { return true })
+	})
+
+	const count = 500
+	for i := 0; i < count; i++ {
+		addr := netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i / 256), byte(i)}), 27015)
+		manager.Add(&ServerInfo{Address: addr.String(), GameDir: "cstrike", Listed: true, Region: regionAll}, 0)
+	}
+	// 未验证的、IPv6 的和不满足过滤条件的服务器不出现在列表中
+	manager.Add(&ServerInfo{Address: "10.1.0.1:27015"}, 0)
+	manager.Add(&ServerInfo{Address: "[2001:db8::1]:27015", GameDir: "cstrike", Listed: true, Region: regionAll}, 0)
+	manager.Add(&ServerInfo{Address: "10.1.0.2:27015", GameDir: "valve", Listed: true, Region: regionAll}, 0)
+
+	server, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	clientAddr := client.LocalAddr().(*net.UDPAddr)
+
+	maxEntries := (masterMaxPacket - len(masterReplyHeader) - 6) / 6
+	var got []netip.AddrPort
+	seed := "0.0.0.0:0"
+	for page := 0; ; page++ {
+		if page > count/maxEntries+1 {
+			t.Fatalf("no terminator after %d pages", page)
+		}
+		handleMasterQuery(server, clientAddr, []byte("1\xFF"+seed+"\x00\\gamedir\\cstrike\x00"))
+		client.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 2048)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("page %d: %v", page, err)
+		}
+		resp := buf[:n]
+		if n > masterMaxPacket || !bytes.HasPrefix(resp, masterReplyHeader) || (n-len(masterReplyHeader))%6 != 0 {
+			t.Fatalf("page %d: malformed reply of %d bytes: %x", page, n, resp[:min(n, 16)])
+		}
+		entries := resp[len(masterReplyHeader):]
+		done := false
+		for len(entries) > 0 {
+			ap := netip.AddrPortFrom(netip.AddrFrom4([4]byte(entries[:4])), binary.BigEndian.Uint16(entries[4:6]))
+			entries = entries[6:]
+			if ap == netip.AddrPortFrom(netip.IPv4Unspecified(), 0) {
+				if len(entries) != 0 {
+					t.Fatalf("page %d: terminator is not the last entry", page)
+				}
+				done = true
+				break
+			}
+			got = append(got, ap)
+		}
+		if done {
+			break
+		}
+		if len(got) != (page+1)*maxEntries {
+			t.Fatalf("page %d: %d entries so far, want full pages of %d", page, len(got), maxEntries)
+		}
+		seed = got[len(got)-1].String()
+	}
+
+	want := listedAddrs(false, func(s *ServerInfo) bool { return s.GameDir == "cstrike" })
+	if len(want) != count {
+		t.Fatalf("listedAddrs() returned %d servers, want %d", len(want), count)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("paged list differs from listedAddrs(): got %d entries, want %d", len(got), len(want))
+	}
+}